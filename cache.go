@@ -0,0 +1,236 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCacheMinTTL = 0
+	DefaultCacheMaxTTL = time.Hour
+	DefaultCacheSize   = 10000
+)
+
+// RecordCache contains the TXT record cache's configuration
+type RecordCache struct {
+	Enable bool
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	Size   int
+	// Stale is the window after the TTL has expired where a previously
+	// good answer keeps being served while it's revalidated in background
+	Stale time.Duration
+
+	store *cacheStore
+}
+
+// cacheStore is a size bounded LRU store of TXT answers keyed
+// by absolute zone
+type cacheStore struct {
+	sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	order   *list.List
+	now     func() time.Time
+}
+
+type cacheEntry struct {
+	zone       string
+	txts       []string
+	err        error
+	expires    time.Time
+	staleUntil time.Time
+	refreshing bool
+}
+
+// cacheResult is an answer served from the cache. err is set for cached
+// negative answers and stale is set when the answer's TTL has expired
+// but it's still within the serve-stale window.
+type cacheResult struct {
+	txts  []string
+	err   error
+	stale bool
+}
+
+// SetDefaults sets the default values for record cache config
+// if the fields are empty
+func (rc *RecordCache) SetDefaults() {
+	if rc.MaxTTL == 0 {
+		rc.MaxTTL = DefaultCacheMaxTTL
+	}
+	if rc.MinTTL > rc.MaxTTL {
+		rc.MinTTL = rc.MaxTTL
+	}
+	if rc.Size == 0 {
+		rc.Size = DefaultCacheSize
+	}
+	if rc.store == nil {
+		rc.store = newCacheStore(rc.Size)
+	}
+}
+
+// sameSettings reports whether both caches are configured the same way
+func (rc RecordCache) sameSettings(other RecordCache) bool {
+	rc.store, other.store = nil, nil
+	return rc == other
+}
+
+func newCacheStore(size int) *cacheStore {
+	return &cacheStore{
+		size:    size,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+// get returns the cached answer for the given absolute zone if it
+// exists and hasn't expired yet or it's still within the stale window
+func (rc RecordCache) get(zone string) (cacheResult, bool) {
+	if !rc.Enable || rc.store == nil {
+		return cacheResult{}, false
+	}
+	s := rc.store
+	s.Lock()
+	defer s.Unlock()
+
+	el, ok := s.entries[zone]
+	if !ok {
+		return cacheResult{}, false
+	}
+	entry := el.Value.(*cacheEntry)
+	now := s.now()
+	if !now.Before(entry.staleUntil) {
+		s.remove(el)
+		return cacheResult{}, false
+	}
+	s.order.MoveToFront(el)
+	return cacheResult{
+		txts:  entry.txts,
+		err:   entry.err,
+		stale: !now.Before(entry.expires),
+	}, true
+}
+
+// set stores the TXT records for the given absolute zone. The
+// given TTL is clamped between the configured min and max TTL.
+func (rc RecordCache) set(zone string, txts []string, ttl time.Duration) {
+	if !rc.Enable || rc.store == nil {
+		return
+	}
+	ttl = rc.clamp(ttl)
+	if ttl <= 0 {
+		return
+	}
+	rc.store.put(zone, txts, nil, ttl, rc.Stale)
+}
+
+// setNegative stores a negative answer for the given absolute zone.
+// Negative answers are kept for the given SOA TTL capped by the max TTL
+// and they're never served stale.
+func (rc RecordCache) setNegative(zone string, err error, ttl time.Duration) {
+	if !rc.Enable || rc.store == nil {
+		return
+	}
+	if rc.MaxTTL > 0 && ttl > rc.MaxTTL {
+		ttl = rc.MaxTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	rc.store.put(zone, nil, err, ttl, 0)
+}
+
+// startRefresh marks the given zone's entry as being revalidated. It
+// returns false if the entry is missing or another refresh is running.
+func (rc RecordCache) startRefresh(zone string) bool {
+	if rc.store == nil {
+		return false
+	}
+	s := rc.store
+	s.Lock()
+	defer s.Unlock()
+
+	el, ok := s.entries[zone]
+	if !ok {
+		return false
+	}
+	entry := el.Value.(*cacheEntry)
+	if entry.refreshing {
+		return false
+	}
+	entry.refreshing = true
+	return true
+}
+
+// endRefresh clears the refreshing mark of the given zone's entry so
+// the next stale hit retries the revalidation if it has failed
+func (rc RecordCache) endRefresh(zone string) {
+	if rc.store == nil {
+		return
+	}
+	s := rc.store
+	s.Lock()
+	defer s.Unlock()
+
+	if el, ok := s.entries[zone]; ok {
+		el.Value.(*cacheEntry).refreshing = false
+	}
+}
+
+func (rc RecordCache) clamp(ttl time.Duration) time.Duration {
+	if ttl < rc.MinTTL {
+		ttl = rc.MinTTL
+	}
+	if rc.MaxTTL > 0 && ttl > rc.MaxTTL {
+		ttl = rc.MaxTTL
+	}
+	return ttl
+}
+
+// put inserts or replaces the given zone's entry and evicts the least
+// recently used entries when the store is full
+func (s *cacheStore) put(zone string, txts []string, err error, ttl, stale time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := s.now()
+	if el, ok := s.entries[zone]; ok {
+		entry := el.Value.(*cacheEntry)
+		entry.txts, entry.err = txts, err
+		entry.expires, entry.staleUntil = now.Add(ttl), now.Add(ttl+stale)
+		s.order.MoveToFront(el)
+		return
+	}
+	s.entries[zone] = s.order.PushFront(&cacheEntry{
+		zone:       zone,
+		txts:       txts,
+		err:        err,
+		expires:    now.Add(ttl),
+		staleUntil: now.Add(ttl + stale),
+	})
+	for s.size > 0 && s.order.Len() > s.size {
+		s.remove(s.order.Back())
+	}
+}
+
+// remove deletes the given element from the store. The caller
+// must hold the store's lock.
+func (s *cacheStore) remove(el *list.Element) {
+	s.order.Remove(el)
+	delete(s.entries, el.Value.(*cacheEntry).zone)
+}
@@ -0,0 +1,246 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecordCache(t *testing.T) {
+	tests := []struct {
+		minTTL   time.Duration
+		maxTTL   time.Duration
+		ttl      time.Duration
+		elapsed  time.Duration
+		expected bool
+	}{
+		{
+			0,
+			time.Hour,
+			60 * time.Second,
+			30 * time.Second,
+			true,
+		},
+		{
+			0,
+			time.Hour,
+			60 * time.Second,
+			61 * time.Second,
+			false,
+		},
+		{
+			5 * time.Minute,
+			time.Hour,
+			60 * time.Second,
+			2 * time.Minute,
+			true,
+		},
+		{
+			0,
+			30 * time.Second,
+			60 * time.Second,
+			45 * time.Second,
+			false,
+		},
+		{
+			0,
+			time.Hour,
+			0,
+			0,
+			false,
+		},
+	}
+	for i, test := range tests {
+		now := time.Now()
+		rc := RecordCache{
+			Enable: true,
+			MinTTL: test.minTTL,
+			MaxTTL: test.maxTTL,
+		}
+		rc.SetDefaults()
+		rc.store.now = func() time.Time { return now }
+
+		rc.set("_redirect.example.test.", []string{"v=txtv0;to=https://example.test"}, test.ttl)
+		now = now.Add(test.elapsed)
+
+		if _, ok := rc.get("_redirect.example.test."); ok != test.expected {
+			t.Errorf("Test %d: Expected cache hit to be %t but got %t", i, test.expected, ok)
+		}
+	}
+}
+
+func TestRecordCacheEviction(t *testing.T) {
+	rc := RecordCache{
+		Enable: true,
+		Size:   2,
+	}
+	rc.SetDefaults()
+
+	rc.set("_redirect.a.test.", []string{"a"}, time.Minute)
+	rc.set("_redirect.b.test.", []string{"b"}, time.Minute)
+	// Touch the first zone so the second one is the least recently used
+	rc.get("_redirect.a.test.")
+	rc.set("_redirect.c.test.", []string{"c"}, time.Minute)
+
+	if _, ok := rc.get("_redirect.b.test."); ok {
+		t.Errorf("Expected the least recently used zone to be evicted")
+	}
+	for _, zone := range []string{"_redirect.a.test.", "_redirect.c.test."} {
+		if _, ok := rc.get(zone); !ok {
+			t.Errorf("Expected %s to be in the cache", zone)
+		}
+	}
+}
+
+func Test_queryCache(t *testing.T) {
+	c := Config{
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Cache: RecordCache{
+			Enable: true,
+		},
+	}
+	c.Cache.SetDefaults()
+
+	if _, err := query("about.test", context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+	cached, ok := c.Cache.get("_redirect.about.test.")
+	if !ok {
+		t.Fatalf("Expected the answer to be cached after the query")
+	}
+	if cached.txts[0] != txts["_redirect.about.test."] {
+		t.Errorf("Expected %s, got %s", txts["_redirect.about.test."], cached.txts[0])
+	}
+}
+
+func TestRecordCacheNegative(t *testing.T) {
+	var queries int32
+	dns.HandleFunc("negative.test.", func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		m.Ns = append(m.Ns, &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "negative.test.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+			Ns:     "ns.negative.test.",
+			Mbox:   "hostmaster.negative.test.",
+			Minttl: 60,
+		})
+		w.WriteMsg(m)
+	})
+	defer dns.HandleRemove("negative.test.")
+
+	now := time.Now()
+	c := Config{
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Cache: RecordCache{
+			Enable: true,
+		},
+	}
+	c.Cache.SetDefaults()
+	c.Cache.store.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, err := query("negative.test", context.Background(), c); err == nil {
+			t.Fatalf("Expected the query to fail with a negative answer")
+		}
+	}
+	if got := atomic.LoadInt32(&queries); got != 1 {
+		t.Errorf("Expected the negative answer to be cached, but the resolver got %d queries", got)
+	}
+
+	// The SOA minimum (60s) is lower than the SOA TTL and should be used
+	now = now.Add(61 * time.Second)
+	query("negative.test", context.Background(), c)
+	if got := atomic.LoadInt32(&queries); got != 2 {
+		t.Errorf("Expected the negative answer to expire after the SOA minimum, but the resolver got %d queries", got)
+	}
+}
+
+func TestRecordCacheStale(t *testing.T) {
+	var queries int32
+	var failing int32
+	dns.HandleFunc("stale.test.", func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		m := new(dns.Msg)
+		if atomic.LoadInt32(&failing) == 1 {
+			m.SetRcode(r, dns.RcodeServerFailure)
+			w.WriteMsg(m)
+			return
+		}
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{"v=txtv0;to=https://stale.test"},
+		})
+		w.WriteMsg(m)
+	})
+	defer dns.HandleRemove("stale.test.")
+
+	now := time.Now()
+	c := Config{
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Cache: RecordCache{
+			Enable: true,
+			Stale:  time.Hour,
+		},
+	}
+	c.Cache.SetDefaults()
+	var mu sync.Mutex
+	c.Cache.store.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+
+	if _, err := query("stale.test", context.Background(), c); err != nil {
+		t.Fatal(err)
+	}
+
+	// Upstream starts failing after the TTL has expired
+	atomic.StoreInt32(&failing, 1)
+	mu.Lock()
+	now = now.Add(2 * time.Minute)
+	mu.Unlock()
+
+	txts, err := query("stale.test", context.Background(), c)
+	if err != nil {
+		t.Fatalf("Expected the stale record to be served, got error: %s", err)
+	}
+	if txts[0] != "v=txtv0;to=https://stale.test" {
+		t.Errorf("Expected the stale record to be served, got %s", txts[0])
+	}
+
+	// Wait for the background revalidation to hit the resolver
+	for i := 0; i < 100 && atomic.LoadInt32(&queries) < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := atomic.LoadInt32(&queries); got != 2 {
+		t.Errorf("Expected a background revalidation, but the resolver got %d queries", got)
+	}
+
+	// The stale window is over
+	mu.Lock()
+	now = now.Add(2 * time.Hour)
+	mu.Unlock()
+	if _, err := query("stale.test", context.Background(), c); err == nil {
+		t.Errorf("Expected the query to fail after the stale window")
+	}
+}
@@ -0,0 +1,507 @@
+/*
+Copyright 2017 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package caddyplugin registers TXTDirect as a plugin of Caddy's http
+// server. Caddy only runs the directives of its directive list, so the
+// Caddy build has to list "txtdirect" in httpserver's directives, after
+// "errors" and before "redir".
+package caddyplugin
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	txtdirect "github.com/txtdirect/txtdirect"
+)
+
+func init() {
+	caddy.RegisterPlugin("txtdirect", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// TXTDirect is the Caddy middleware that serves the redirects
+type TXTDirect struct {
+	Next   httpserver.Handler
+	Config txtdirect.Config
+}
+
+func (rd TXTDirect) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if err := rd.Config.Serve(w, r); err != nil {
+		if err.Error() == "option disabled" {
+			return rd.Next.ServeHTTP(w, r)
+		}
+		return http.StatusInternalServerError, err
+	}
+	return 0, nil
+}
+
+func setup(c *caddy.Controller) error {
+	config, err := parse(c)
+	if err != nil {
+		return err
+	}
+	config.SetDefaults()
+	if err := config.SetupLogger(); err != nil {
+		return err
+	}
+
+	if config.Prometheus.Enable {
+		if err := config.Prometheus.Setup(); err != nil {
+			return err
+		}
+	}
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return TXTDirect{Next: next, Config: config}
+	})
+	return nil
+}
+
+// parse turns the txtdirect directive into a Config:
+//
+//	txtdirect {
+//		enable host path         # or: disable gometa
+//		redirect https://example.com
+//		resolver 127.0.0.1:53
+//		logfile /var/log/txtdirect.log {
+//			max_size 100
+//			max_age 30
+//			max_backups 10
+//			compress
+//		}
+//		loglevel warn
+//		path_chain_depth 5
+//		ref_max_hops 5
+//		trace_token secret
+//		source zonefile db.example.com example.com
+//		resolvers {
+//			upstream 1.1.1.1:53 1s
+//			strategy random
+//			timeout 2s
+//			max_fails 3
+//			eject_for 30s
+//		}
+//		dnssec validate {
+//			trust_anchor ". IN DS 20326 8 2 E06D..."
+//		}
+//		cache {
+//			min_ttl 30s
+//			max_ttl 1h
+//			size 1000
+//			stale 1m
+//		}
+//		gomods {
+//			gobinary /usr/local/go/bin/go
+//			workers 2
+//			cache {
+//				type local
+//				path /tmp/gomods
+//			}
+//		}
+//		prometheus {
+//			address localhost:9183
+//			path /metrics
+//		}
+//		host *.example.org {
+//			enable host www
+//			redirect https://example.org
+//			resolver 127.0.0.1:53
+//			resolvers {
+//				upstream 8.8.8.8:53
+//			}
+//		}
+//	}
+func parse(c *caddy.Controller) (txtdirect.Config, error) {
+	var config txtdirect.Config
+	var enable, disable []string
+
+	for c.Next() {
+		// The directive can be used without a block
+		if len(c.RemainingArgs()) != 0 {
+			return txtdirect.Config{}, c.ArgErr()
+		}
+		for c.NextBlock() {
+			option := c.Val()
+			var err error
+			switch option {
+			case "enable", "disable":
+				err = parseOptions(c, &enable, &disable)
+
+			case "redirect":
+				err = parseString(c, &config.Redirect)
+
+			case "resolver":
+				err = parseString(c, &config.Resolver)
+
+			case "logfile":
+				if err = parseString(c, &config.LogOutput); err == nil {
+					err = parseBlock(c, func(key string) error {
+						return parseLogRotate(c, key, &config.LogRotate)
+					})
+				}
+
+			case "loglevel":
+				if err = parseString(c, &config.LogLevel); err == nil {
+					switch config.LogLevel {
+					case txtdirect.LevelDebug, txtdirect.LevelInfo, txtdirect.LevelWarn, txtdirect.LevelError:
+					default:
+						err = c.Errf("unknown log level %s, expected debug, info, warn or error", config.LogLevel)
+					}
+				}
+
+			case "path_chain_depth":
+				err = parseInt(c, &config.PathChainDepth)
+
+			case "ref_max_hops":
+				err = parseInt(c, &config.RefMaxHops)
+
+			case "trace_token":
+				err = parseString(c, &config.TraceToken)
+
+			case "source":
+				err = parseSource(c, &config)
+
+			case "resolvers":
+				err = parseBlock(c, func(key string) error {
+					return parseResolvers(c, key, &config.Resolvers)
+				})
+
+			case "dnssec":
+				mode := c.RemainingArgs()
+				if len(mode) != 1 {
+					return txtdirect.Config{}, c.ArgErr()
+				}
+				if mode[0] != "ad" && mode[0] != "validate" {
+					return txtdirect.Config{}, c.Errf("unknown DNSSEC mode %s, expected ad or validate", mode[0])
+				}
+				config.DNSSEC.Mode = mode[0]
+				err = parseBlock(c, func(key string) error {
+					if key != "trust_anchor" {
+						return c.Errf("unknown dnssec option %s", key)
+					}
+					anchor := c.RemainingArgs()
+					if len(anchor) != 1 {
+						return c.ArgErr()
+					}
+					config.DNSSEC.TrustAnchors = append(config.DNSSEC.TrustAnchors, anchor[0])
+					return nil
+				})
+
+			case "cache":
+				config.Cache.Enable = true
+				err = parseBlock(c, func(key string) error {
+					return parseCache(c, key, &config.Cache)
+				})
+
+			case "gomods":
+				config.Gomods.Enable = true
+				err = parseBlock(c, func(key string) error {
+					return parseGomods(c, key, &config.Gomods)
+				})
+
+			case "prometheus":
+				config.Prometheus.Enable = true
+				err = parseBlock(c, func(key string) error {
+					switch key {
+					case "address":
+						return parseString(c, &config.Prometheus.Address)
+					case "path":
+						return parseString(c, &config.Prometheus.Path)
+					}
+					return c.Errf("unknown prometheus option %s", key)
+				})
+
+			case "host":
+				var hc txtdirect.HostConfig
+				hc, err = parseHost(c)
+				config.Hosts = append(config.Hosts, hc)
+
+			default:
+				return txtdirect.Config{}, c.Errf("unknown txtdirect option %s", option)
+			}
+			if err != nil {
+				return txtdirect.Config{}, err
+			}
+		}
+	}
+
+	config.Enable = enabledOptions(enable, disable)
+	if config.Enable == nil {
+		config.Enable = append([]string{}, txtdirect.AllOptions...)
+	}
+	return config, nil
+}
+
+// parseHost parses the overrides of the hosts matching the pattern
+func parseHost(c *caddy.Controller) (txtdirect.HostConfig, error) {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return txtdirect.HostConfig{}, c.ArgErr()
+	}
+	hc := txtdirect.HostConfig{Pattern: args[0]}
+	var enable, disable []string
+	err := parseBlock(c, func(key string) error {
+		switch key {
+		case "enable", "disable":
+			return parseOptions(c, &enable, &disable)
+		case "redirect":
+			return parseString(c, &hc.Redirect)
+		case "resolver":
+			return parseString(c, &hc.Resolver)
+		case "resolvers":
+			return parseBlock(c, func(key string) error {
+				return parseResolvers(c, key, &hc.Resolvers)
+			})
+		}
+		return c.Errf("unknown host option %s", key)
+	})
+	if err != nil {
+		return txtdirect.HostConfig{}, err
+	}
+	hc.Enable = enabledOptions(enable, disable)
+	if err := hc.Validate(); err != nil {
+		return txtdirect.HostConfig{}, c.Err(err.Error())
+	}
+	return hc, nil
+}
+
+// parseOptions parses the redirect types of an enable or disable line.
+// Only one of them can be used in a block.
+func parseOptions(c *caddy.Controller, enable, disable *[]string) error {
+	key := c.Val()
+	if *enable != nil || *disable != nil {
+		return c.Err("only one of enable and disable can be used")
+	}
+	options := c.RemainingArgs()
+	if len(options) == 0 {
+		return c.ArgErr()
+	}
+	for _, o := range options {
+		if !contains(txtdirect.AllOptions, o) {
+			return c.Errf("unknown option %s in %s, expected one of %v", o, key, txtdirect.AllOptions)
+		}
+	}
+	if key == "enable" {
+		*enable = options
+	} else {
+		*disable = options
+	}
+	return nil
+}
+
+// enabledOptions returns the enabled options of the enable or disable
+// list, or nil when neither of them is used
+func enabledOptions(enable, disable []string) []string {
+	if disable == nil {
+		return enable
+	}
+	options := []string{}
+	for _, o := range txtdirect.AllOptions {
+		if !contains(disable, o) {
+			options = append(options, o)
+		}
+	}
+	return options
+}
+
+func contains(array []string, word string) bool {
+	for _, w := range array {
+		if w == word {
+			return true
+		}
+	}
+	return false
+}
+
+func parseResolvers(c *caddy.Controller, key string, rs *txtdirect.Resolvers) error {
+	switch key {
+	case "upstream":
+		args := c.RemainingArgs()
+		if len(args) != 1 && len(args) != 2 {
+			return c.ArgErr()
+		}
+		u := txtdirect.Upstream{Address: args[0]}
+		if len(args) == 2 {
+			timeout, err := time.ParseDuration(args[1])
+			if err != nil {
+				return c.Errf("invalid timeout %s for upstream %s: %s", args[1], args[0], err)
+			}
+			u.Timeout = timeout
+		}
+		rs.Upstreams = append(rs.Upstreams, u)
+		return nil
+	case "strategy":
+		if err := parseString(c, &rs.Strategy); err != nil {
+			return err
+		}
+		switch rs.Strategy {
+		case "sequential", "random", "fastest":
+			return nil
+		}
+		return c.Errf("unknown resolvers strategy %s, expected sequential, random or fastest", rs.Strategy)
+	case "timeout":
+		return parseDuration(c, &rs.Timeout)
+	case "max_fails":
+		return parseInt(c, &rs.MaxFails)
+	case "eject_for":
+		return parseDuration(c, &rs.EjectFor)
+	}
+	return c.Errf("unknown resolvers option %s", key)
+}
+
+func parseCache(c *caddy.Controller, key string, rc *txtdirect.RecordCache) error {
+	switch key {
+	case "min_ttl":
+		return parseDuration(c, &rc.MinTTL)
+	case "max_ttl":
+		return parseDuration(c, &rc.MaxTTL)
+	case "size":
+		return parseInt(c, &rc.Size)
+	case "stale":
+		return parseDuration(c, &rc.Stale)
+	}
+	return c.Errf("unknown cache option %s", key)
+}
+
+func parseLogRotate(c *caddy.Controller, key string, lr *txtdirect.LogRotate) error {
+	switch key {
+	case "max_size":
+		return parseInt(c, &lr.MaxSize)
+	case "max_age":
+		return parseInt(c, &lr.MaxAge)
+	case "max_backups":
+		return parseInt(c, &lr.MaxBackups)
+	case "compress":
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		lr.Compress = true
+		return nil
+	}
+	return c.Errf("unknown logfile option %s", key)
+}
+
+func parseGomods(c *caddy.Controller, key string, gomods *txtdirect.Gomods) error {
+	switch key {
+	case "gobinary":
+		return parseString(c, &gomods.GoBinary)
+	case "workers":
+		return parseInt(c, &gomods.Workers)
+	case "cache":
+		gomods.Cache.Enable = true
+		return parseBlock(c, func(key string) error {
+			switch key {
+			case "type":
+				return parseString(c, &gomods.Cache.Type)
+			case "path":
+				return parseString(c, &gomods.Cache.Path)
+			}
+			return c.Errf("unknown gomods cache option %s", key)
+		})
+	}
+	return c.Errf("unknown gomods option %s", key)
+}
+
+// parseSource parses the source option, either "zonefile <path> [origin]"
+// or "mapfile <path>"
+func parseSource(c *caddy.Controller, config *txtdirect.Config) error {
+	args := c.RemainingArgs()
+	if len(args) < 2 {
+		return c.ArgErr()
+	}
+	var err error
+	switch args[0] {
+	case "zonefile":
+		if len(args) > 3 {
+			return c.ArgErr()
+		}
+		origin := ""
+		if len(args) == 3 {
+			origin = args[2]
+		}
+		config.Source, err = txtdirect.NewZoneFileSource(args[1], origin)
+	case "mapfile":
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		config.Source, err = txtdirect.NewMapFileSource(args[1])
+	default:
+		return c.Errf("unknown source %s, expected zonefile or mapfile", args[0])
+	}
+	if err != nil {
+		return c.Errf("couldn't load the %s source: %s", args[0], err)
+	}
+	return nil
+}
+
+// parseBlock calls fn with the first token of every line of the block
+// that opens on the current line. The options without a block are valid.
+func parseBlock(c *caddy.Controller, fn func(key string) error) error {
+	if !c.NextArg() {
+		return nil
+	}
+	if c.Val() != "{" {
+		return c.SyntaxErr("{")
+	}
+	for c.Next() {
+		if c.Val() == "}" {
+			return nil
+		}
+		if err := fn(c.Val()); err != nil {
+			return err
+		}
+	}
+	return c.EOFErr()
+}
+
+func parseString(c *caddy.Controller, value *string) error {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	*value = args[0]
+	return nil
+}
+
+func parseInt(c *caddy.Controller, value *int) error {
+	key := c.Val()
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	i, err := strconv.Atoi(args[0])
+	if err != nil || i < 0 {
+		return c.Errf("invalid %s value %s, expected a non-negative integer", key, args[0])
+	}
+	*value = i
+	return nil
+}
+
+func parseDuration(c *caddy.Controller, value *time.Duration) error {
+	key := c.Val()
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.ArgErr()
+	}
+	d, err := time.ParseDuration(args[0])
+	if err != nil || d < 0 {
+		return c.Errf("invalid %s value %s, expected a duration such as 30s", key, args[0])
+	}
+	*value = d
+	return nil
+}
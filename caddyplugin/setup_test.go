@@ -0,0 +1,267 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package caddyplugin
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+	txtdirect "github.com/txtdirect/txtdirect"
+)
+
+func TestSetupPlugin(t *testing.T) {
+	// The plugins of the directives that aren't in Caddy's directive
+	// list are listed with the others
+	plugins := caddy.ListPlugins()
+	if !contains(plugins["http"], "txtdirect") && !contains(plugins["others"], "http.txtdirect") {
+		t.Fatalf("Expected txtdirect to be a plugin of the http server, got %v", plugins)
+	}
+}
+
+func TestSetupParse(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected txtdirect.Config
+	}{
+		{
+			`txtdirect`,
+			txtdirect.Config{Enable: txtdirect.AllOptions},
+		},
+		{
+			`txtdirect {
+				enable host path
+				redirect https://example.com
+				resolver 127.0.0.1:53
+				logfile stdout
+				loglevel debug
+			}`,
+			txtdirect.Config{
+				Enable:    []string{"host", "path"},
+				Redirect:  "https://example.com",
+				Resolver:  "127.0.0.1:53",
+				LogOutput: "stdout",
+				LogLevel:  "debug",
+			},
+		},
+		{
+			`txtdirect {
+				logfile /var/log/txtdirect.log {
+					max_size 10
+					max_age 7
+					max_backups 3
+					compress
+				}
+			}`,
+			txtdirect.Config{
+				Enable:    txtdirect.AllOptions,
+				LogOutput: "/var/log/txtdirect.log",
+				LogRotate: txtdirect.LogRotate{MaxSize: 10, MaxAge: 7, MaxBackups: 3, Compress: true},
+			},
+		},
+		{
+			`txtdirect {
+				disable gometa www gomods
+				path_chain_depth 3
+				ref_max_hops 2
+				trace_token secret
+			}`,
+			txtdirect.Config{
+				Enable:         []string{"host", "path", "proxy", "dockerv2"},
+				PathChainDepth: 3,
+				RefMaxHops:     2,
+				TraceToken:     "secret",
+			},
+		},
+		{
+			`txtdirect {
+				resolvers {
+					upstream 1.1.1.1:53
+					upstream tls://9.9.9.9:853 1s
+					strategy random
+					timeout 2s
+					max_fails 5
+					eject_for 1m
+				}
+				dnssec validate {
+					trust_anchor ". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"
+				}
+				cache {
+					min_ttl 30s
+					max_ttl 1h
+					size 100
+					stale 5m
+				}
+			}`,
+			txtdirect.Config{
+				Enable: txtdirect.AllOptions,
+				Resolvers: txtdirect.Resolvers{
+					Upstreams: []txtdirect.Upstream{
+						{Address: "1.1.1.1:53"},
+						{Address: "tls://9.9.9.9:853", Timeout: time.Second},
+					},
+					Strategy: "random",
+					Timeout:  2 * time.Second,
+					MaxFails: 5,
+					EjectFor: time.Minute,
+				},
+				DNSSEC: txtdirect.DNSSEC{
+					Mode:         "validate",
+					TrustAnchors: []string{". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"},
+				},
+				Cache: txtdirect.RecordCache{
+					Enable: true,
+					MinTTL: 30 * time.Second,
+					MaxTTL: time.Hour,
+					Size:   100,
+					Stale:  5 * time.Minute,
+				},
+			},
+		},
+		{
+			`txtdirect {
+				dnssec ad
+				cache
+				gomods {
+					gobinary /usr/local/go/bin/go
+					workers 2
+					cache {
+						type local
+						path /tmp/gomods
+					}
+				}
+				prometheus {
+					address localhost:9999
+					path /stats
+				}
+			}`,
+			txtdirect.Config{
+				Enable: txtdirect.AllOptions,
+				DNSSEC: txtdirect.DNSSEC{Mode: "ad"},
+				Cache:  txtdirect.RecordCache{Enable: true},
+				Gomods: txtdirect.Gomods{
+					Enable:   true,
+					GoBinary: "/usr/local/go/bin/go",
+					Workers:  2,
+					Cache:    txtdirect.Cache{Enable: true, Type: "local", Path: "/tmp/gomods"},
+				},
+				Prometheus: txtdirect.Prometheus{Enable: true, Address: "localhost:9999", Path: "/stats"},
+			},
+		},
+		{
+			`txtdirect {
+				gomods
+				prometheus
+			}`,
+			txtdirect.Config{
+				Enable:     txtdirect.AllOptions,
+				Gomods:     txtdirect.Gomods{Enable: true},
+				Prometheus: txtdirect.Prometheus{Enable: true},
+			},
+		},
+		{
+			`txtdirect {
+				enable host
+				host *.example.org {
+					disable www gomods
+					redirect https://example.org
+					resolvers {
+						upstream 8.8.8.8:53
+					}
+				}
+				host example.net {
+					resolver 127.0.0.1:53
+				}
+			}`,
+			txtdirect.Config{
+				Enable: []string{"host"},
+				Hosts: []txtdirect.HostConfig{
+					{
+						Pattern:   "*.example.org",
+						Enable:    []string{"host", "path", "gometa", "proxy", "dockerv2"},
+						Redirect:  "https://example.org",
+						Resolvers: txtdirect.Resolvers{Upstreams: []txtdirect.Upstream{{Address: "8.8.8.8:53"}}},
+					},
+					{Pattern: "example.net", Resolver: "127.0.0.1:53"},
+				},
+			},
+		},
+	}
+	for i, test := range tests {
+		c := caddy.NewTestController("http", test.input)
+		config, err := parse(c)
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(config, test.expected) {
+			t.Errorf("Test %d: expected %+v, got %+v", i, test.expected, config)
+		}
+	}
+}
+
+func TestSetupParseErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"txtdirect example.com", "Wrong argument count"},
+		{"txtdirect {\nunknown\n}", "unknown txtdirect option unknown"},
+		{"txtdirect {\nenable\n}", "Wrong argument count"},
+		{"txtdirect {\nenable host ftp\n}", "unknown option ftp in enable"},
+		{"txtdirect {\nenable host\ndisable path\n}", "only one of enable and disable can be used"},
+		{"txtdirect {\nredirect\n}", "Wrong argument count"},
+		{"txtdirect {\nloglevel verbose\n}", "unknown log level verbose"},
+		{"txtdirect {\nlogfile txtdirect.log {\nmax_size -1\n}\n}", "invalid max_size value -1"},
+		{"txtdirect {\nlogfile txtdirect.log {\ncompress yes\n}\n}", "Wrong argument count"},
+		{"txtdirect {\nredirect a b\n}", "Wrong argument count"},
+		{"txtdirect {\npath_chain_depth many\n}", "invalid path_chain_depth value many"},
+		{"txtdirect {\nref_max_hops -1\n}", "invalid ref_max_hops value -1"},
+		{"txtdirect {\nsource ldap example.com\n}", "unknown source ldap"},
+		{"txtdirect {\nsource zonefile /nonexistent/db.example\n}", "couldn't load the zonefile source"},
+		{"txtdirect {\nresolvers {\nstrategy fair\n}\n}", "unknown resolvers strategy fair"},
+		{"txtdirect {\nresolvers {\ntimeout soon\n}\n}", "invalid timeout value soon"},
+		{"txtdirect {\nresolvers {\nupstream 1.1.1.1:53 soon\n}\n}", "invalid timeout soon for upstream 1.1.1.1:53"},
+		{"txtdirect {\nresolvers {\nretries 3\n}\n}", "unknown resolvers option retries"},
+		{"txtdirect {\ndnssec\n}", "Wrong argument count"},
+		{"txtdirect {\ndnssec strict\n}", "unknown DNSSEC mode strict"},
+		{"txtdirect {\ndnssec validate {\nanchor x\n}\n}", "unknown dnssec option anchor"},
+		{"txtdirect {\ncache {\nsize -5\n}\n}", "invalid size value -5"},
+		{"txtdirect {\ncache {\nttl 1m\n}\n}", "unknown cache option ttl"},
+		{"txtdirect {\ngomods {\nworkers x\n}\n}", "invalid workers value x"},
+		{"txtdirect {\ngomods {\ncache {\nkind tmp\n}\n}\n}", "unknown gomods cache option kind"},
+		{"txtdirect {\ngomods {\nproxy on\n}\n}", "unknown gomods option proxy"},
+		{"txtdirect {\nprometheus {\nport 9183\n}\n}", "unknown prometheus option port"},
+		{"txtdirect {\nprometheus {\naddress localhost:9183\n", "Unexpected EOF"},
+		{"txtdirect {\nhost\n}", "Wrong argument count"},
+		{"txtdirect {\nhost a.*.example.org\n}", "invalid host pattern"},
+		{"txtdirect {\nhost example.org {\nenable ftp\n}\n}", "unknown option ftp in enable"},
+		{"txtdirect {\nhost example.org {\nenable host\ndisable www\n}\n}", "only one of enable and disable can be used"},
+		{"txtdirect {\nhost example.org {\ncache\n}\n}", "unknown host option cache"},
+		{"txtdirect {\ncache x\n}", "Unexpected token 'x', expecting '{'"},
+	}
+	for _, test := range tests {
+		c := caddy.NewTestController("http", test.input)
+		_, err := parse(c)
+		if err == nil {
+			t.Errorf("Expected an error for %q", test.input)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("Expected %q for %q, got %q", test.expected, test.input, err)
+		}
+	}
+}
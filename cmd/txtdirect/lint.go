@@ -0,0 +1,101 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	txtdirect "github.com/txtdirect/txtdirect"
+)
+
+const lintUsage = `Usage: txtdirect lint [flags] [host | record]...
+
+Checks the TXT records of the given hosts, the _redirect records of a zone file or
+the given raw records. Arguments that contain "=" are used as records,
+the others are resolved as hosts. It exits with 1 when a problem is found.
+
+Flags:
+`
+
+// runLint runs the lint command and returns the exit code
+func runLint(args []string) int {
+	fs := flag.NewFlagSet("lint", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), lintUsage)
+		fs.PrintDefaults()
+	}
+	enable := fs.String("enable", "host,path,gometa,gomods,dockerv2,proxy", "comma separated list of the enabled record types")
+	zoneFile := fs.String("zone", "", "zone file to check")
+	origin := fs.String("origin", "", "origin of the zone file")
+	resolver := fs.String("resolver", "", "DNS resolver used to look up the hosts, e.g. 8.8.8.8:53")
+	timeout := fs.Duration("timeout", 5*time.Second, "timeout of each host lookup")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *zoneFile == "" && fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	c := txtdirect.Config{
+		Enable:   strings.Split(*enable, ","),
+		Resolver: *resolver,
+	}
+
+	var problems []txtdirect.LintProblem
+	if *zoneFile != "" {
+		source, err := txtdirect.NewZoneFileSource(*zoneFile, *origin)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "txtdirect: %s\n", err)
+			return 2
+		}
+		problems = append(problems, txtdirect.LintSource(source, c)...)
+	}
+
+	failed := false
+	for _, arg := range fs.Args() {
+		if strings.Contains(arg, "=") {
+			for _, msg := range txtdirect.LintRecord(arg, c) {
+				problems = append(problems, txtdirect.LintProblem{Record: arg, Message: msg})
+			}
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		hostProblems, err := txtdirect.LintHost(arg, ctx, c)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "txtdirect: couldn't look up %s: %s\n", arg, err)
+			failed = true
+			continue
+		}
+		problems = append(problems, hostProblems...)
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	switch {
+	case failed:
+		return 2
+	case len(problems) != 0:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	txtdirect "github.com/txtdirect/txtdirect"
+)
+
+const serveUsage = `Usage: txtdirect serve [flags]
+
+Serves the TXTDirect redirects over HTTP and optionally HTTPS until it
+receives SIGINT or SIGTERM, then it waits for the in-flight requests.
+With -config the redirects are configured by the YAML or JSON file instead
+of the flags, and the file is reloaded on SIGHUP or when it's modified.
+
+Flags:
+`
+
+// runServe runs the server and returns the exit code
+func runServe(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), serveUsage)
+		fs.PrintDefaults()
+	}
+	httpAddr := fs.String("http", ":80", "address of the HTTP listener, empty to disable it")
+	httpsAddr := fs.String("https", "", "address of the HTTPS listener, e.g. :443")
+	certFile := fs.String("cert", "", "TLS certificate file of the HTTPS listener")
+	keyFile := fs.String("key", "", "TLS key file of the HTTPS listener")
+	configFile := fs.String("config", "", "YAML or JSON config file")
+	watchInterval := fs.Duration("watch-interval", 5*time.Second, "interval of the config file checks, 0 to reload only on SIGHUP")
+	enable := fs.String("enable", "host,path,gometa", "comma separated list of the enabled record types")
+	redirect := fs.String("redirect", "", "global fallback address")
+	resolver := fs.String("resolver", "", "DNS resolver used to look up the records, e.g. 8.8.8.8:53")
+	traceToken := fs.String("trace-token", "", "token of the X-TXTDirect-Trace header, empty to disable the traces")
+	logOutput := fs.String("log", "", "JSON log output, stdout, stderr or a file path, empty for plain logs")
+	logLevel := fs.String("log-level", "info", "minimum level of the JSON logs: debug, info, warn or error")
+	logMaxSize := fs.Int("log-max-size", 100, "size in megabytes that rotates the log file")
+	logMaxAge := fs.Int("log-max-age", 0, "days to keep the rotated log files, 0 to keep them forever")
+	logMaxBackups := fs.Int("log-max-backups", 0, "number of rotated log files to keep, 0 to keep them all")
+	logCompress := fs.Bool("log-compress", false, "gzip the rotated log files")
+	metrics := fs.Bool("metrics", false, "export the Prometheus metrics")
+	metricsAddr := fs.String("metrics-addr", "", "address of the Prometheus metrics")
+	shutdownTimeout := fs.Duration("shutdown-timeout", 10*time.Second, "time to wait for the in-flight requests on shutdown")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if *httpAddr == "" && *httpsAddr == "" {
+		fmt.Fprintln(os.Stderr, "txtdirect: at least one of -http and -https is required")
+		return 2
+	}
+	if *httpsAddr != "" && (*certFile == "" || *keyFile == "") {
+		fmt.Fprintln(os.Stderr, "txtdirect: -https requires -cert and -key")
+		return 2
+	}
+
+	handler := txtdirect.NewHandler(txtdirect.Config{
+		Enable:     strings.Split(*enable, ","),
+		Redirect:   *redirect,
+		Resolver:   *resolver,
+		TraceToken: *traceToken,
+		LogOutput:  *logOutput,
+		LogLevel:   *logLevel,
+		LogRotate: txtdirect.LogRotate{
+			MaxSize:    *logMaxSize,
+			MaxAge:     *logMaxAge,
+			MaxBackups: *logMaxBackups,
+			Compress:   *logCompress,
+		},
+		Prometheus: txtdirect.Prometheus{Enable: *metrics, Address: *metricsAddr},
+	})
+	if *configFile != "" {
+		if err := handler.LoadFile(*configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "txtdirect: %s\n", err)
+			return 1
+		}
+	} else {
+		c := handler.Config()
+		c.SetDefaults()
+		if err := c.SetupLogger(); err != nil {
+			fmt.Fprintf(os.Stderr, "txtdirect: %s\n", err)
+			return 1
+		}
+		if c.Prometheus.Enable {
+			if err := c.Prometheus.Setup(); err != nil {
+				fmt.Fprintf(os.Stderr, "txtdirect: %s\n", err)
+				return 1
+			}
+		}
+		handler.SetConfig(c)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	if *configFile != "" && *watchInterval > 0 {
+		go handler.WatchFile(*configFile, *watchInterval, done)
+	}
+
+	var servers []*http.Server
+	errs := make(chan error, 2)
+	if *httpAddr != "" {
+		srv := newServer(*httpAddr, handler)
+		servers = append(servers, srv)
+		go func() {
+			log.Printf("[txtdirect]: listening on %s", srv.Addr)
+			errs <- srv.ListenAndServe()
+		}()
+	}
+	if *httpsAddr != "" {
+		srv := newServer(*httpsAddr, handler)
+		srv.TLSConfig = &tls.Config{
+			MinVersion:               tls.VersionTLS12,
+			PreferServerCipherSuites: true,
+		}
+		servers = append(servers, srv)
+		go func() {
+			log.Printf("[txtdirect]: listening on %s", srv.Addr)
+			errs <- srv.ListenAndServeTLS(*certFile, *keyFile)
+		}()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	code := 0
+wait:
+	for {
+		select {
+		case <-reload:
+			if *configFile == "" {
+				log.Printf("[txtdirect]: received SIGHUP without a config file to reload")
+				continue
+			}
+			if err := handler.LoadFile(*configFile); err != nil {
+				log.Printf("[txtdirect]: couldn't reload %s, keeping the current config: %s", *configFile, err)
+				continue
+			}
+			log.Printf("[txtdirect]: reloaded %s", *configFile)
+		case sig := <-stop:
+			log.Printf("[txtdirect]: received %s, shutting down", sig)
+			break wait
+		case err := <-errs:
+			log.Printf("[txtdirect]: %s", err)
+			code = 1
+			break wait
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("[txtdirect]: couldn't shut down %s gracefully: %s", srv.Addr, err)
+			code = 1
+		}
+	}
+	return code
+}
+
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      60 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+}
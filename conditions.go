@@ -0,0 +1,114 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// conditionOperators are the supported comparison operators of
+// the when= conditions
+var conditionOperators = []string{"==", "!=", "^=", "$=", "*="}
+
+// condition compares the value of the left side, which usually is a
+// placeholder such as {>Accept-Language}, to the right side
+type condition struct {
+	left  string
+	op    string
+	right string
+}
+
+// parseConditions parses the comma separated conditions of a when=
+// key, e.g. "{ua_class}==mobile,{?lang}!=en". All the conditions
+// have to match for the record to be used.
+func parseConditions(when string) ([]condition, error) {
+	var conditions []condition
+	for _, c := range strings.Split(when, ",") {
+		index, op := -1, ""
+		for _, o := range conditionOperators {
+			if i := strings.Index(c, o); i != -1 && (index == -1 || i < index) {
+				index, op = i, o
+			}
+		}
+		if index < 1 {
+			return nil, fmt.Errorf("could not parse condition '%s'", c)
+		}
+		conditions = append(conditions, condition{
+			left:  c[:index],
+			op:    op,
+			right: c[index+len(op):],
+		})
+	}
+	return conditions, nil
+}
+
+// match checks the condition against the given request
+func (c condition) match(r *http.Request) (bool, error) {
+	value, err := parsePlaceholders(c.left, r, []string{})
+	if err != nil {
+		return false, err
+	}
+	// Headers and cookies that aren't sent are left as-is by the parser
+	if value == c.left && PlaceholderRegex.MatchString(c.left) {
+		value = ""
+	}
+
+	switch c.op {
+	case "==":
+		return value == c.right, nil
+	case "!=":
+		return value != c.right, nil
+	case "^=":
+		return strings.HasPrefix(value, c.right), nil
+	case "$=":
+		return strings.HasSuffix(value, c.right), nil
+	case "*=":
+		return strings.Contains(value, c.right), nil
+	}
+	return false, fmt.Errorf("unknown operator '%s'", c.op)
+}
+
+// matchConditions checks if the request matches every condition
+// of the given when= key
+func matchConditions(when string, r *http.Request) (bool, error) {
+	conditions, err := parseConditions(when)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range conditions {
+		ok, err := c.match(r)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// userAgentClass classifies the user agent as "bot", "mobile" or "desktop"
+func userAgentClass(ua string) string {
+	ua = strings.ToLower(ua)
+	for _, s := range []string{"bot", "crawler", "spider", "slurp", "curl", "wget"} {
+		if strings.Contains(ua, s) {
+			return "bot"
+		}
+	}
+	for _, s := range []string{"mobile", "android", "iphone", "ipad", "ipod"} {
+		if strings.Contains(ua, s) {
+			return "mobile"
+		}
+	}
+	return "desktop"
+}
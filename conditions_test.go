@@ -0,0 +1,168 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const (
+	mobileUA  = "Mozilla/5.0 (iPhone; CPU iPhone OS 12_2 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148"
+	desktopUA = "Mozilla/5.0 (X11; Linux x86_64; rv:66.0) Gecko/20100101 Firefox/66.0"
+	botUA     = "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+)
+
+func Test_parseConditions(t *testing.T) {
+	tests := []struct {
+		when     string
+		expected []condition
+		err      bool
+	}{
+		{
+			"{ua_class}==mobile",
+			[]condition{{"{ua_class}", "==", "mobile"}},
+			false,
+		},
+		{
+			"{>Accept-Language}^=de,{?ref}!=",
+			[]condition{{"{>Accept-Language}", "^=", "de"}, {"{?ref}", "!=", ""}},
+			false,
+		},
+		{
+			"{~session}*=beta==",
+			[]condition{{"{~session}", "*=", "beta=="}},
+			false,
+		},
+		{"{method}", nil, true},
+		{"==GET", nil, true},
+		{"{method}==GET,", nil, true},
+	}
+	for i, test := range tests {
+		conditions, err := parseConditions(test.when)
+		if test.err {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error, got %v", i, conditions)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: Unexpected error: %s", i, err)
+			continue
+		}
+		if len(conditions) != len(test.expected) {
+			t.Errorf("Test %d: Expected %v, got %v", i, test.expected, conditions)
+			continue
+		}
+		for j := range conditions {
+			if conditions[j] != test.expected[j] {
+				t.Errorf("Test %d: Expected %v, got %v", i, test.expected[j], conditions[j])
+			}
+		}
+	}
+}
+
+func Test_matchConditions(t *testing.T) {
+	req := httptest.NewRequest("POST", "https://example.test/page?lang=fr&ref=newsletter", nil)
+	req.Header.Set("Accept-Language", "de-DE,de;q=0.9")
+	req.Header.Set("User-Agent", mobileUA)
+	req.AddCookie(&http.Cookie{Name: "beta", Value: "enabled"})
+
+	tests := []struct {
+		when     string
+		expected bool
+	}{
+		{"{method}==POST", true},
+		{"{method}==GET", false},
+		{"{method}!=GET", true},
+		{"{>Accept-Language}^=de", true},
+		{"{>Accept-Language}^=en", false},
+		{"{>X-Missing}==", true},
+		{"{?lang}==fr", true},
+		{"{?ref}$=letter", true},
+		{"{~beta}==enabled", true},
+		{"{~missing}==enabled", false},
+		{"{ua_class}==mobile", true},
+		{"{>User-Agent}*=iPhone", true},
+		{"{ua_class}==mobile,{?lang}==fr", true},
+		{"{ua_class}==mobile,{?lang}==en", false},
+	}
+	for _, test := range tests {
+		match, err := matchConditions(test.when, req)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", test.when, err)
+			continue
+		}
+		if match != test.expected {
+			t.Errorf("Expected %s to be %t, got %t", test.when, test.expected, match)
+		}
+	}
+}
+
+func Test_userAgentClass(t *testing.T) {
+	for ua, expected := range map[string]string{
+		mobileUA:  "mobile",
+		desktopUA: "desktop",
+		botUA:     "bot",
+		"":        "desktop",
+	} {
+		if class := userAgentClass(ua); class != expected {
+			t.Errorf("Expected %s for %q, got %s", expected, ua, class)
+		}
+	}
+}
+
+func TestConditionsE2e(t *testing.T) {
+	c := Config{
+		Enable: []string{"host", "path"},
+		Source: NewStaticSource(map[string][]string{
+			"when.test": {
+				"v=txtv0;to=https://m.when.test;when={ua_class}==mobile;priority=1",
+				"v=txtv0;to=https://de.when.test;when={>Accept-Language}^=de;priority=2",
+				"v=txtv0;to=https://www.when.test;priority=3",
+			},
+			"onlymobile.when.test":          {"v=txtv0;to=https://m.onlymobile.when.test;when={ua_class}==mobile"},
+			"_.when.test":                   {"v=txtv0;to=https://wildcard.when.test"},
+			"path.when.test":                {"v=txtv0;to=https://path.when.test;type=path"},
+			"_redirect.beta.path.when.test": {"v=txtv0;to=https://beta.path.when.test;when={?beta}==1"},
+		}),
+	}
+	tests := []struct {
+		url      string
+		ua       string
+		lang     string
+		expected string
+	}{
+		{"https://when.test", mobileUA, "de", "https://m.when.test"},
+		{"https://when.test", desktopUA, "de-AT", "https://de.when.test"},
+		{"https://when.test", desktopUA, "en", "https://www.when.test"},
+		{"https://onlymobile.when.test", mobileUA, "", "https://m.onlymobile.when.test"},
+		{"https://onlymobile.when.test", desktopUA, "", "https://wildcard.when.test"},
+		{"https://path.when.test/beta?beta=1", desktopUA, "", "https://beta.path.when.test"},
+		{"https://path.when.test/beta", desktopUA, "", "https://path.when.test"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Header.Set("User-Agent", test.ua)
+		req.Header.Set("Accept-Language", test.lang)
+		resp := httptest.NewRecorder()
+		if err := c.Serve(resp, req); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if location := resp.Header().Get("Location"); location != test.expected {
+			t.Errorf("Expected %s to redirect to %s, got %s", test.url, test.expected, location)
+		}
+	}
+}
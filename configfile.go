@@ -0,0 +1,412 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+)
+
+// configFile is the schema of the YAML and JSON config files, e.g.:
+//
+//	enable: [host, path]
+//	redirect: https://example.com
+//	logfile: /var/log/txtdirect.log
+//	logrotate:
+//	  max_size: 100
+//	  max_backups: 10
+//	resolvers:
+//	  upstreams:
+//	    - address: 1.1.1.1:53
+//	      timeout: 1s
+//	  strategy: random
+//	cache:
+//	  enable: true
+//	  max_ttl: 1h
+//	prometheus:
+//	  enable: true
+//	  address: localhost:9183
+type configFile struct {
+	Enable         []string  `yaml:"enable"`
+	Disable        []string  `yaml:"disable"`
+	Redirect       string    `yaml:"redirect"`
+	Resolver       string    `yaml:"resolver"`
+	LogFile        string    `yaml:"logfile"`
+	LogLevel       string    `yaml:"loglevel"`
+	LogRotate      LogRotate `yaml:"logrotate"`
+	PathChainDepth int       `yaml:"path_chain_depth"`
+	RefMaxHops     int       `yaml:"ref_max_hops"`
+	TraceToken     string    `yaml:"trace_token"`
+	Source         *struct {
+		ZoneFile string `yaml:"zonefile"`
+		Origin   string `yaml:"origin"`
+		MapFile  string `yaml:"mapfile"`
+	} `yaml:"source"`
+	Resolvers fileResolvers `yaml:"resolvers"`
+	DNSSEC    struct {
+		Mode         string   `yaml:"mode"`
+		TrustAnchors []string `yaml:"trust_anchors"`
+	} `yaml:"dnssec"`
+	Cache struct {
+		Enable bool         `yaml:"enable"`
+		MinTTL fileDuration `yaml:"min_ttl"`
+		MaxTTL fileDuration `yaml:"max_ttl"`
+		Size   int          `yaml:"size"`
+		Stale  fileDuration `yaml:"stale"`
+	} `yaml:"cache"`
+	Gomods struct {
+		Enable   bool   `yaml:"enable"`
+		GoBinary string `yaml:"gobinary"`
+		Workers  int    `yaml:"workers"`
+		Cache    Cache  `yaml:"cache"`
+	} `yaml:"gomods"`
+	Prometheus struct {
+		Enable  bool   `yaml:"enable"`
+		Address string `yaml:"address"`
+		Path    string `yaml:"path"`
+	} `yaml:"prometheus"`
+	Hosts []struct {
+		Pattern   string        `yaml:"pattern"`
+		Enable    []string      `yaml:"enable"`
+		Disable   []string      `yaml:"disable"`
+		Redirect  string        `yaml:"redirect"`
+		Resolver  string        `yaml:"resolver"`
+		Resolvers fileResolvers `yaml:"resolvers"`
+	} `yaml:"hosts"`
+}
+
+type fileResolvers struct {
+	Upstreams []struct {
+		Address string       `yaml:"address"`
+		Timeout fileDuration `yaml:"timeout"`
+	} `yaml:"upstreams"`
+	Strategy string       `yaml:"strategy"`
+	Timeout  fileDuration `yaml:"timeout"`
+	MaxFails int          `yaml:"max_fails"`
+	EjectFor fileDuration `yaml:"eject_for"`
+}
+
+func (f fileResolvers) resolvers() Resolvers {
+	rs := Resolvers{
+		Strategy: f.Strategy,
+		Timeout:  time.Duration(f.Timeout),
+		MaxFails: f.MaxFails,
+		EjectFor: time.Duration(f.EjectFor),
+	}
+	for _, u := range f.Upstreams {
+		rs.Upstreams = append(rs.Upstreams, Upstream{
+			Address: u.Address,
+			Timeout: time.Duration(u.Timeout),
+		})
+	}
+	return rs
+}
+
+// fileDuration is a duration written as a string such as "30s"
+type fileDuration time.Duration
+
+func (d *fileDuration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %s, expected a duration such as 30s", s)
+	}
+	*d = fileDuration(v)
+	return nil
+}
+
+// LoadConfig reads the YAML or JSON config file. Unknown keys are
+// rejected and the relative paths of the record source are relative
+// to the config file.
+func LoadConfig(path string) (Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("couldn't read the config file: %s", err)
+	}
+
+	// JSON is a subset of YAML, so both formats are parsed the same way
+	var f configFile
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return Config{}, fmt.Errorf("couldn't parse the config file: %s", err)
+	}
+
+	c := Config{
+		Redirect:       f.Redirect,
+		Resolver:       f.Resolver,
+		LogOutput:      f.LogFile,
+		LogLevel:       f.LogLevel,
+		LogRotate:      f.LogRotate,
+		PathChainDepth: f.PathChainDepth,
+		RefMaxHops:     f.RefMaxHops,
+		TraceToken:     f.TraceToken,
+		Resolvers:      f.Resolvers.resolvers(),
+		DNSSEC: DNSSEC{
+			Mode:         f.DNSSEC.Mode,
+			TrustAnchors: f.DNSSEC.TrustAnchors,
+		},
+		Cache: RecordCache{
+			Enable: f.Cache.Enable,
+			MinTTL: time.Duration(f.Cache.MinTTL),
+			MaxTTL: time.Duration(f.Cache.MaxTTL),
+			Size:   f.Cache.Size,
+			Stale:  time.Duration(f.Cache.Stale),
+		},
+		Gomods: Gomods{
+			Enable:   f.Gomods.Enable,
+			GoBinary: f.Gomods.GoBinary,
+			Workers:  f.Gomods.Workers,
+			Cache:    f.Gomods.Cache,
+		},
+		Prometheus: Prometheus{
+			Enable:  f.Prometheus.Enable,
+			Address: f.Prometheus.Address,
+			Path:    f.Prometheus.Path,
+		},
+	}
+	if c.Enable, err = enabledOptions(f.Enable, f.Disable); err != nil {
+		return Config{}, err
+	}
+	if c.Enable == nil {
+		c.Enable = append([]string{}, AllOptions...)
+	}
+	for _, h := range f.Hosts {
+		hc := HostConfig{
+			Pattern:   h.Pattern,
+			Redirect:  h.Redirect,
+			Resolver:  h.Resolver,
+			Resolvers: h.Resolvers.resolvers(),
+		}
+		if hc.Enable, err = enabledOptions(h.Enable, h.Disable); err != nil {
+			return Config{}, fmt.Errorf("invalid config for %s: %s", h.Pattern, err)
+		}
+		c.Hosts = append(c.Hosts, hc)
+	}
+
+	if f.Source != nil {
+		dir := filepath.Dir(path)
+		switch {
+		case f.Source.ZoneFile != "" && f.Source.MapFile != "":
+			return Config{}, fmt.Errorf("only one of zonefile and mapfile can be used as the source")
+		case f.Source.ZoneFile != "":
+			c.Source, err = NewZoneFileSource(relativeTo(dir, f.Source.ZoneFile), f.Source.Origin)
+		case f.Source.MapFile != "":
+			c.Source, err = NewMapFileSource(relativeTo(dir, f.Source.MapFile))
+		default:
+			return Config{}, fmt.Errorf("the source requires a zonefile or a mapfile")
+		}
+		if err != nil {
+			return Config{}, err
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+// enabledOptions returns the enabled options of the enable or disable
+// lists, it's nil when neither of them is used
+func enabledOptions(enable, disable []string) ([]string, error) {
+	switch {
+	case enable != nil && disable != nil:
+		return nil, fmt.Errorf("only one of enable and disable can be used")
+	case disable != nil:
+		options := []string{}
+		for _, o := range disable {
+			if !contains(AllOptions, o) {
+				return nil, fmt.Errorf("unknown option %s in disable, expected one of %v", o, AllOptions)
+			}
+		}
+		for _, o := range AllOptions {
+			if !contains(disable, o) {
+				options = append(options, o)
+			}
+		}
+		return options, nil
+	}
+	return enable, nil
+}
+
+func relativeTo(dir, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// Validate checks the config for invalid values
+func (c Config) Validate() error {
+	for _, o := range c.Enable {
+		if !contains(AllOptions, o) {
+			return fmt.Errorf("unknown option %s in enable, expected one of %v", o, AllOptions)
+		}
+	}
+	if c.Redirect != "" {
+		if u, err := url.Parse(c.Redirect); err != nil || !u.IsAbs() {
+			return fmt.Errorf("redirect must be an absolute URL, got %s", c.Redirect)
+		}
+	}
+	if _, ok := logLevels[c.LogLevel]; c.LogLevel != "" && !ok {
+		return fmt.Errorf("unknown log level %s, expected debug, info, warn or error", c.LogLevel)
+	}
+	if c.LogRotate.MaxSize < 0 || c.LogRotate.MaxAge < 0 || c.LogRotate.MaxBackups < 0 {
+		return fmt.Errorf("the logrotate's max_size, max_age and max_backups can't be negative")
+	}
+	if c.PathChainDepth < 0 || c.RefMaxHops < 0 {
+		return fmt.Errorf("path_chain_depth and ref_max_hops can't be negative")
+	}
+
+	switch c.Resolvers.Strategy {
+	case "", "sequential", "random", "fastest":
+	default:
+		return fmt.Errorf("unknown resolvers strategy %s, expected sequential, random or fastest", c.Resolvers.Strategy)
+	}
+	for _, u := range c.Resolvers.Upstreams {
+		if u.Address == "" {
+			return fmt.Errorf("the upstreams of the resolvers require an address")
+		}
+	}
+	if c.Resolvers.MaxFails < 0 || c.Resolvers.Timeout < 0 || c.Resolvers.EjectFor < 0 {
+		return fmt.Errorf("the resolvers' timeout, max_fails and eject_for can't be negative")
+	}
+
+	switch c.DNSSEC.Mode {
+	case "", "ad", "validate":
+	default:
+		return fmt.Errorf("unknown DNSSEC mode %s, expected ad or validate", c.DNSSEC.Mode)
+	}
+	for _, anchor := range c.DNSSEC.TrustAnchors {
+		if _, err := dns.NewRR(anchor); err != nil {
+			return fmt.Errorf("invalid DNSSEC trust anchor %s: %s", anchor, err)
+		}
+	}
+
+	if c.Cache.Size < 0 || c.Cache.MinTTL < 0 || c.Cache.MaxTTL < 0 || c.Cache.Stale < 0 {
+		return fmt.Errorf("the cache's size, min_ttl, max_ttl and stale can't be negative")
+	}
+	if c.Gomods.Workers < 0 {
+		return fmt.Errorf("the gomods workers can't be negative")
+	}
+	for _, hc := range c.Hosts {
+		if err := hc.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadFile loads the config file and swaps the handler's config with it.
+// The requests that are being served keep using the previous config and
+// it's kept when the file is invalid.
+func (h *Handler) LoadFile(path string) error {
+	c, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	c.SetDefaults()
+	if c.Prometheus.Enable {
+		if err := c.Prometheus.Setup(); err != nil {
+			return err
+		}
+	}
+	current, _ := h.config.Load().(Config)
+	c.keepState(current)
+	// The log file is kept open when it's still used
+	if current.LogOutput == c.LogOutput && current.LogLevel == c.LogLevel && current.LogRotate == c.LogRotate {
+		c.logger = current.logger
+	}
+	if err := c.SetupLogger(); err != nil {
+		return err
+	}
+	h.SetConfig(c)
+	// Otherwise the previous log file is closed once it's swapped out
+	if current.logger != c.logger {
+		current.logger.Close()
+	}
+	return nil
+}
+
+// keepState carries the cached answers and the health of the upstreams
+// over from the previous config when their settings haven't changed, so
+// a reload doesn't send every query to the resolvers at once
+func (c *Config) keepState(prev Config) {
+	sameResolvers := c.Resolver == prev.Resolver && c.Resolvers.sameSettings(prev.Resolvers)
+	if sameResolvers && prev.Resolvers.pool != nil {
+		c.Resolvers.pool = prev.Resolvers.pool
+	}
+	// The cached answers depend on the resolvers and their validation
+	if sameResolvers && c.Cache.sameSettings(prev.Cache) && c.DNSSEC.Mode == prev.DNSSEC.Mode &&
+		equalStrings(c.DNSSEC.TrustAnchors, prev.DNSSEC.TrustAnchors) && prev.Cache.store != nil {
+		c.Cache.store = prev.Cache.store
+	}
+	for i := range c.Hosts {
+		for _, hc := range prev.Hosts {
+			if hc.Pattern == c.Hosts[i].Pattern && hc.Resolvers.pool != nil && c.Hosts[i].Resolvers.sameSettings(hc.Resolvers) {
+				c.Hosts[i].Resolvers.pool = hc.Resolvers.pool
+			}
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// WatchFile reloads the config file into the handler whenever the file
+// is modified. It polls the file every interval until stop is closed.
+func (h *Handler) WatchFile(path string, interval time.Duration, stop <-chan struct{}) {
+	last, _ := os.Stat(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		last = info
+		if err := h.LoadFile(path); err != nil {
+			h.Config().logger.Errorf("couldn't reload %s, keeping the current config: %s", path, err)
+			continue
+		}
+		h.Config().logger.Infof("reloaded %s", path)
+	}
+}
@@ -0,0 +1,344 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected Config
+	}{
+		{
+			"empty.yaml",
+			"",
+			Config{Enable: AllOptions},
+		},
+		{
+			"config.yaml",
+			`
+enable: [host, path]
+redirect: https://example.com
+resolver: 127.0.0.1:53
+logfile: stdout
+logrotate:
+  max_size: 10
+  max_backups: 3
+  compress: true
+path_chain_depth: 3
+trace_token: secret
+resolvers:
+  upstreams:
+    - address: 1.1.1.1:53
+    - address: tls://9.9.9.9:853
+      timeout: 1s
+  strategy: random
+  eject_for: 1m
+dnssec:
+  mode: ad
+cache:
+  enable: true
+  max_ttl: 1h
+gomods:
+  enable: true
+  workers: 2
+  cache:
+    enable: true
+    type: tmp
+prometheus:
+  enable: true
+  address: localhost:9999
+`,
+			Config{
+				Enable:         []string{"host", "path"},
+				Redirect:       "https://example.com",
+				Resolver:       "127.0.0.1:53",
+				LogOutput:      "stdout",
+				LogRotate:      LogRotate{MaxSize: 10, MaxBackups: 3, Compress: true},
+				PathChainDepth: 3,
+				TraceToken:     "secret",
+				Resolvers: Resolvers{
+					Upstreams: []Upstream{
+						{Address: "1.1.1.1:53"},
+						{Address: "tls://9.9.9.9:853", Timeout: time.Second},
+					},
+					Strategy: "random",
+					EjectFor: time.Minute,
+				},
+				DNSSEC:     DNSSEC{Mode: "ad"},
+				Cache:      RecordCache{Enable: true, MaxTTL: time.Hour},
+				Gomods:     Gomods{Enable: true, Workers: 2, Cache: Cache{Enable: true, Type: "tmp"}},
+				Prometheus: Prometheus{Enable: true, Address: "localhost:9999"},
+			},
+		},
+		{
+			"config.json",
+			`{"disable": ["www", "gomods"], "ref_max_hops": 2, "cache": {"enable": true, "stale": "30s"}}`,
+			Config{
+				Enable:     []string{"host", "path", "gometa", "proxy", "dockerv2"},
+				RefMaxHops: 2,
+				Cache:      RecordCache{Enable: true, Stale: 30 * time.Second},
+			},
+		},
+		{
+			"hosts.yaml",
+			`
+hosts:
+  - pattern: "*.example.org"
+    disable: [www]
+    redirect: https://example.org
+  - pattern: example.net
+    resolvers:
+      upstreams:
+        - address: 8.8.8.8:53
+`,
+			Config{
+				Enable: AllOptions,
+				Hosts: []HostConfig{
+					{
+						Pattern:  "*.example.org",
+						Enable:   []string{"host", "path", "gometa", "proxy", "dockerv2", "gomods"},
+						Redirect: "https://example.org",
+					},
+					{Pattern: "example.net", Resolvers: Resolvers{Upstreams: []Upstream{{Address: "8.8.8.8:53"}}}},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		path, cleanup := writeTestFile(t, test.name, test.content)
+		c, err := LoadConfig(path)
+		cleanup()
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(c, test.expected) {
+			t.Errorf("Expected %+v for %s, got %+v", test.expected, test.name, c)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		content  string
+		expected string
+	}{
+		{"enable: [host]\nredirects: https://example.com", "field redirects not found"},
+		{"enable: host", "couldn't parse the config file"},
+		{"enable: [host, ftp]", "unknown option ftp in enable"},
+		{"disable: [ftp]", "unknown option ftp in disable"},
+		{"enable: [host]\ndisable: [path]", "only one of enable and disable can be used"},
+		{"redirect: example.com", "redirect must be an absolute URL"},
+		{"ref_max_hops: -1", "can't be negative"},
+		{"loglevel: verbose", "unknown log level verbose"},
+		{"logrotate: {max_age: -1}", "can't be negative"},
+		{"resolvers:\n  timeout: soon", "invalid duration soon"},
+		{"resolvers:\n  strategy: fair", "unknown resolvers strategy fair"},
+		{"resolvers:\n  upstreams:\n    - timeout: 1s", "require an address"},
+		{"dnssec:\n  mode: strict", "unknown DNSSEC mode strict"},
+		{"dnssec:\n  mode: validate\n  trust_anchors: [bogus]", "invalid DNSSEC trust anchor bogus"},
+		{"cache:\n  size: -1", "can't be negative"},
+		{"hosts:\n  - pattern: a.*.example.org", "invalid host pattern"},
+		{"hosts:\n  - pattern: example.org\n    enable: [ftp]", "invalid config for example.org: unknown option ftp in enable"},
+		{"hosts:\n  - pattern: example.org\n    disable: [ftp]", "invalid config for example.org: unknown option ftp in disable"},
+		{"source:\n  origin: example.com", "the source requires a zonefile or a mapfile"},
+		{"source:\n  mapfile: missing.yaml", "couldn't read the map file"},
+	}
+	for _, test := range tests {
+		path, cleanup := writeTestFile(t, "config.yaml", test.content)
+		_, err := LoadConfig(path)
+		cleanup()
+		if err == nil {
+			t.Errorf("Expected an error for %q", test.content)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("Expected %q for %q, got %q", test.expected, test.content, err)
+		}
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	path, cleanup := writeTestFile(t, "config.yaml", "enable: [host]\nsource:\n  mapfile: records.yaml")
+	defer cleanup()
+	writeRecords := func(to string) {
+		records := "example.test: v=txtv1;to=" + to
+		if err := ioutil.WriteFile(filepath.Join(filepath.Dir(path), "records.yaml"), []byte(records), 0644); err != nil {
+			t.Fatalf("Couldn't write the records: %s", err)
+		}
+	}
+	location := func(h *Handler) string {
+		req := httptest.NewRequest("GET", "https://example.test", nil)
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, req)
+		return resp.Header().Get("Location")
+	}
+	touch := func(offset time.Duration) {
+		mtime := time.Now().Add(offset)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatalf("Couldn't touch the config file: %s", err)
+		}
+	}
+
+	writeRecords("https://first.test")
+	h := NewHandler(Config{})
+	if err := h.LoadFile(path); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if l := location(h); l != "https://first.test" {
+		t.Errorf("Expected https://first.test, got %s", l)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go h.WatchFile(path, 10*time.Millisecond, stop)
+	time.Sleep(30 * time.Millisecond)
+
+	// The records are read again when the config file changes
+	writeRecords("https://second.test")
+	touch(time.Hour)
+	waitFor(t, func() bool { return location(h) == "https://second.test" })
+
+	// An invalid config file keeps the current config
+	if err := ioutil.WriteFile(path, []byte("enable: [ftp]"), 0644); err != nil {
+		t.Fatalf("Couldn't write the config file: %s", err)
+	}
+	touch(2 * time.Hour)
+	if err := h.LoadFile(path); err == nil {
+		t.Errorf("Expected an error for the invalid config")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if l := location(h); l != "https://second.test" {
+		t.Errorf("Expected the previous config to be kept, got %s", l)
+	}
+}
+
+func TestConfigReloadLogFile(t *testing.T) {
+	path, cleanup := writeTestFile(t, "config.yaml", "")
+	defer cleanup()
+	dir := filepath.Dir(path)
+	if err := ioutil.WriteFile(path, []byte("logfile: "+filepath.Join(dir, "first.log")), 0644); err != nil {
+		t.Fatalf("Couldn't write the config file: %s", err)
+	}
+
+	h := NewHandler(Config{})
+	if err := h.LoadFile(path); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	first := h.Config().logger
+
+	// The logger is kept when its settings don't change
+	if err := h.LoadFile(path); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if h.Config().logger != first || first.sink.closed {
+		t.Errorf("Expected the logger to be kept")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("logfile: "+filepath.Join(dir, "second.log")+"\nlogrotate: {max_size: 1}"), 0644); err != nil {
+		t.Fatalf("Couldn't write the config file: %s", err)
+	}
+	if err := h.LoadFile(path); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if h.Config().logger == first || !first.sink.closed {
+		t.Errorf("Expected the previous logger to be closed")
+	}
+
+	// The requests that still use the previous logger don't reopen its file
+	first.Infof("late")
+	h.Config().logger.Infof("current")
+	for name, expected := range map[string]string{"first.log": "", "second.log": "current"} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil || !strings.Contains(string(data), expected) || name == "first.log" && len(data) != 0 {
+			t.Errorf("Unexpected content of %s: %q %v", name, data, err)
+		}
+	}
+}
+
+func TestConfigReloadState(t *testing.T) {
+	path, cleanup := writeTestFile(t, "config.yaml", "")
+	defer cleanup()
+	write := func(size, upstream string) {
+		config := "cache:\n  enable: true\n  size: " + size + "\nresolvers:\n  upstreams:\n    - address: " + upstream +
+			"\nhosts:\n  - pattern: example.net\n    resolvers:\n      upstreams:\n        - address: 8.8.8.8:53\n"
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatalf("Couldn't write the config file: %s", err)
+		}
+	}
+	h := NewHandler(Config{})
+	load := func() Config {
+		if err := h.LoadFile(path); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		return h.Config()
+	}
+
+	write("100", "1.1.1.1:53")
+	first := load()
+	if first.Cache.store == nil || first.Resolvers.pool == nil || first.Hosts[0].Resolvers.pool == nil {
+		t.Fatalf("Expected the cache and the upstream pools to be set up")
+	}
+	first.Cache.set("_redirect.example.test.", []string{"v=txtv1;to=https://example.test"}, time.Minute)
+
+	// The cached answers and the health of the upstreams survive a reload
+	second := load()
+	if second.Cache.store != first.Cache.store || second.Resolvers.pool != first.Resolvers.pool ||
+		second.Hosts[0].Resolvers.pool != first.Hosts[0].Resolvers.pool {
+		t.Errorf("Expected the cache and the upstream pools to be kept")
+	}
+	if _, ok := second.Cache.get("_redirect.example.test."); !ok {
+		t.Errorf("Expected the cached answer to be kept")
+	}
+
+	write("200", "1.1.1.1:53")
+	third := load()
+	if third.Cache.store == second.Cache.store {
+		t.Errorf("Expected a new cache when its size changes")
+	}
+	if third.Resolvers.pool != second.Resolvers.pool {
+		t.Errorf("Expected the upstream pool to be kept when the cache changes")
+	}
+
+	write("200", "9.9.9.9:53")
+	fourth := load()
+	if fourth.Cache.store == third.Cache.store || fourth.Resolvers.pool == third.Resolvers.pool {
+		t.Errorf("Expected a new cache and upstream pool when the upstreams change")
+	}
+	if fourth.Hosts[0].Resolvers.pool != third.Hosts[0].Resolvers.pool {
+		t.Errorf("Expected the host's upstream pool to be kept")
+	}
+}
+
+// waitFor waits up to a second for the condition to become true
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
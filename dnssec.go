@@ -0,0 +1,301 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// dnssecUDPSize is the EDNS0 buffer size advertised on DNSSEC queries
+	dnssecUDPSize = 4096
+	// rootTrustAnchor is the DS record of the root zone's KSK-2017
+	rootTrustAnchor = ". IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"
+)
+
+// DNSSEC contains the DNSSEC validation configuration. Mode can be
+// "ad" to trust the AD flag of a validating resolver or "validate"
+// to validate the signatures up to the trust anchors.
+type DNSSEC struct {
+	Mode string
+	// TrustAnchors are DS or DNSKEY records in presentation format.
+	// The root zone's KSK is used when it's empty.
+	TrustAnchors []string
+}
+
+// validator validates the chain of trust for a single lookup
+type validator struct {
+	c       Config
+	anchors []dns.RR
+	keys    map[string][]*dns.DNSKEY
+	pending map[string]bool
+	now     time.Time
+}
+
+// prepare sets the DO bit on the given query when DNSSEC is enabled.
+// In validate mode the CD bit is also set so the signatures get
+// validated here even if the resolver doesn't validate them.
+func (d DNSSEC) prepare(m *dns.Msg) {
+	switch d.Mode {
+	case "ad":
+		m.SetEdns0(dnssecUDPSize, true)
+		m.AuthenticatedData = true
+	case "validate":
+		m.SetEdns0(dnssecUDPSize, true)
+		m.CheckingDisabled = true
+	}
+}
+
+// check makes sure the TXT records of the zone in the given response
+// are signed and valid based on the DNSSEC mode
+func (d DNSSEC) check(ctx context.Context, zone string, resp *dns.Msg, c Config) error {
+	switch d.Mode {
+	case "":
+		return nil
+	case "ad":
+		if !resp.AuthenticatedData {
+			return fmt.Errorf("the answer is not authenticated by the resolver")
+		}
+		return nil
+	case "validate":
+		v, err := newValidator(c)
+		if err != nil {
+			return err
+		}
+		rrset, sigs := splitRRset(resp.Answer, zone, dns.TypeTXT)
+		if len(rrset) == 0 {
+			return fmt.Errorf("no TXT records to validate")
+		}
+		return v.verify(ctx, rrset, sigs)
+	}
+	return fmt.Errorf("unknown DNSSEC mode %s", d.Mode)
+}
+
+func newValidator(c Config) (*validator, error) {
+	anchors := c.DNSSEC.TrustAnchors
+	if len(anchors) == 0 {
+		anchors = []string{rootTrustAnchor}
+	}
+	v := &validator{
+		c:       c,
+		keys:    make(map[string][]*dns.DNSKEY),
+		pending: make(map[string]bool),
+		now:     time.Now(),
+	}
+	for _, a := range anchors {
+		rr, err := dns.NewRR(a)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse the trust anchor %q: %s", a, err)
+		}
+		switch rr.(type) {
+		case *dns.DS, *dns.DNSKEY:
+			v.anchors = append(v.anchors, rr)
+		default:
+			return nil, fmt.Errorf("trust anchor %q is not a DS or DNSKEY record", a)
+		}
+	}
+	return v, nil
+}
+
+// verify checks that at least one of the given signatures over the
+// RRset verifies with a validated key of the signer zone
+func (v *validator) verify(ctx context.Context, rrset []dns.RR, sigs []*dns.RRSIG) error {
+	if len(sigs) == 0 {
+		return fmt.Errorf("%s is not signed", rrset[0].Header().Name)
+	}
+	var err error
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(v.now) {
+			err = fmt.Errorf("the signature of %s has expired or isn't valid yet", sig.Hdr.Name)
+			continue
+		}
+		if !dns.IsSubDomain(sig.SignerName, sig.Hdr.Name) {
+			err = fmt.Errorf("%s can't be signed by %s", sig.Hdr.Name, sig.SignerName)
+			continue
+		}
+		var keys []*dns.DNSKEY
+		keys, err = v.zoneKeys(ctx, sig.SignerName)
+		if err != nil {
+			continue
+		}
+		if err = verifyWithKeys(sig, keys, rrset); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// zoneKeys returns the DNSKEYs of the given zone once the DNSKEY RRset
+// is validated either by a trust anchor or by the DS records in the
+// parent zone, which are validated recursively
+func (v *validator) zoneKeys(ctx context.Context, zone string) ([]*dns.DNSKEY, error) {
+	zone = canonicalName(zone)
+	if keys, ok := v.keys[zone]; ok {
+		return keys, nil
+	}
+	// A zone can't vouch for its own keys
+	if v.pending[zone] {
+		return nil, fmt.Errorf("loop in the chain of trust of %s", zone)
+	}
+	v.pending[zone] = true
+	defer delete(v.pending, zone)
+
+	resp, err := v.query(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	rrset, sigs := splitRRset(resp.Answer, zone, dns.TypeDNSKEY)
+	if len(rrset) == 0 {
+		return nil, fmt.Errorf("no DNSKEY records found for %s", zone)
+	}
+	var keys []*dns.DNSKEY
+	for _, rr := range rrset {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+
+	var trusted []*dns.DNSKEY
+	if anchors := v.anchorsFor(zone); len(anchors) != 0 {
+		trusted = matchKeys(keys, anchors)
+	} else {
+		if zone == "." {
+			return nil, fmt.Errorf("no trust anchor found for the root zone")
+		}
+		dsResp, err := v.query(ctx, zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+		dsSet, dsSigs := splitRRset(dsResp.Answer, zone, dns.TypeDS)
+		if len(dsSet) == 0 {
+			return nil, fmt.Errorf("%s is an unsigned zone", zone)
+		}
+		if err := v.verify(ctx, dsSet, dsSigs); err != nil {
+			return nil, fmt.Errorf("couldn't validate the DS records of %s: %s", zone, err)
+		}
+		trusted = matchKeys(keys, dsSet)
+	}
+	if len(trusted) == 0 {
+		return nil, fmt.Errorf("none of the DNSKEY records of %s match the chain of trust", zone)
+	}
+
+	// The DNSKEY RRset must be signed by one of the trusted keys
+	var verr error = fmt.Errorf("the DNSKEY records of %s are not signed", zone)
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(v.now) {
+			continue
+		}
+		if verr = verifyWithKeys(sig, trusted, rrset); verr == nil {
+			v.keys[zone] = keys
+			return keys, nil
+		}
+	}
+	return nil, verr
+}
+
+// anchorsFor returns the trust anchors that are configured for the zone
+func (v *validator) anchorsFor(zone string) []dns.RR {
+	var anchors []dns.RR
+	for _, a := range v.anchors {
+		if canonicalName(a.Header().Name) == zone {
+			anchors = append(anchors, a)
+		}
+	}
+	return anchors
+}
+
+// query sends a DNSSEC enabled query for the given name and type
+func (v *validator) query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	v.c.DNSSEC.prepare(m)
+	resp, _, err := v.c.Resolvers.exchange(ctx, m, v.c)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get %s records of %s: %s", dns.TypeToString[qtype], name, err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("couldn't get %s records of %s: %s", dns.TypeToString[qtype], name, dns.RcodeToString[resp.Rcode])
+	}
+	return resp, nil
+}
+
+// verifyWithKeys verifies the signature using the key that matches
+// the signature's key tag and algorithm
+func verifyWithKeys(sig *dns.RRSIG, keys []*dns.DNSKEY, rrset []dns.RR) error {
+	err := fmt.Errorf("no DNSKEY found for the signature of %s with key tag %d", sig.Hdr.Name, sig.KeyTag)
+	for _, k := range keys {
+		if k.KeyTag() != sig.KeyTag || k.Algorithm != sig.Algorithm {
+			continue
+		}
+		if !strings.EqualFold(k.Hdr.Name, sig.SignerName) {
+			continue
+		}
+		if err = sig.Verify(k, rrset); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// matchKeys returns the keys that match the given DS or DNSKEY records
+func matchKeys(keys []*dns.DNSKEY, anchors []dns.RR) []*dns.DNSKEY {
+	var matched []*dns.DNSKEY
+	for _, k := range keys {
+		for _, a := range anchors {
+			switch anchor := a.(type) {
+			case *dns.DS:
+				if anchor.KeyTag != k.KeyTag() || anchor.Algorithm != k.Algorithm {
+					continue
+				}
+				if ds := k.ToDS(anchor.DigestType); ds != nil && strings.EqualFold(ds.Digest, anchor.Digest) {
+					matched = append(matched, k)
+				}
+			case *dns.DNSKEY:
+				if anchor.Algorithm == k.Algorithm && anchor.PublicKey == k.PublicKey {
+					matched = append(matched, k)
+				}
+			}
+		}
+	}
+	return matched
+}
+
+// splitRRset returns the records of the given owner name and type and
+// the signatures that cover them. The records of other owners are left
+// out, so a signed record of another zone can't answer for this one.
+func splitRRset(rrs []dns.RR, name string, qtype uint16) ([]dns.RR, []*dns.RRSIG) {
+	var rrset []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		if !strings.EqualFold(rr.Header().Name, name) {
+			continue
+		}
+		if rr.Header().Rrtype == qtype {
+			rrset = append(rrset, rr)
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == qtype {
+			sigs = append(sigs, sig)
+		}
+	}
+	return rrset, sigs
+}
+
+// canonicalName returns the lowercase and fully qualified form of name
+func canonicalName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
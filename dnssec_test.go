@@ -0,0 +1,208 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"context"
+	"crypto"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// signedZone is a locally signed zone served by the testing DNS server
+type signedZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newSignedZone(t *testing.T, name string) *signedZone {
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("Couldn't generate the zone key: %s", err)
+	}
+	return &signedZone{name, key, priv.(crypto.Signer)}
+}
+
+// sign returns the RRSIG of the given RRset signed by the zone's key
+func (z *signedZone) sign(t *testing.T, rrset []dns.RR) *dns.RRSIG {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Algorithm:  z.key.Algorithm,
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(z.priv, rrset); err != nil {
+		t.Fatalf("Couldn't sign the RRset: %s", err)
+	}
+	return sig
+}
+
+func newTXT(name, txt string) *dns.TXT {
+	return &dns.TXT{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+		Txt: []string{txt},
+	}
+}
+
+// RunSignedZone serves a signed "signed.test." zone and its signed
+// "child.signed.test." delegation along with the testing TXT records.
+// It returns the parent zone, the server's address and a stop function.
+func RunSignedZone(t *testing.T) (*signedZone, string, func()) {
+	parent := newSignedZone(t, "signed.test.")
+	child := newSignedZone(t, "child.signed.test.")
+
+	ds := child.key.ToDS(dns.SHA256)
+	ds.Hdr = dns.RR_Header{Name: child.name, Rrtype: dns.TypeDS, Class: dns.ClassINET, Ttl: 3600}
+
+	good := newTXT("_redirect.good.signed.test.", "v=txtv0;to=https://good.signed.test")
+	bogus := newTXT("_redirect.bogus.signed.test.", "v=txtv0;to=https://attacker.test")
+	nested := newTXT("_redirect.nested.child.signed.test.", "v=txtv0;to=https://nested.signed.test")
+	attacker := newTXT("_redirect.attacker.signed.test.", "v=txtv0;to=https://attacker.test")
+
+	answers := map[string][]dns.RR{
+		"signed.test./DNSKEY":       {parent.key, parent.sign(t, []dns.RR{parent.key})},
+		"child.signed.test./DNSKEY": {child.key, child.sign(t, []dns.RR{child.key})},
+		"child.signed.test./DS":     {ds, parent.sign(t, []dns.RR{ds})},
+		"_redirect.good.signed.test./TXT": {
+			good, parent.sign(t, []dns.RR{good}),
+		},
+		// The signature is made for different data
+		"_redirect.bogus.signed.test./TXT": {
+			bogus, parent.sign(t, []dns.RR{newTXT("_redirect.bogus.signed.test.", "v=txtv0;to=https://bogus.signed.test")}),
+		},
+		"_redirect.unsigned.signed.test./TXT": {
+			newTXT("_redirect.unsigned.signed.test.", "v=txtv0;to=https://unsigned.signed.test"),
+		},
+		"_redirect.nested.child.signed.test./TXT": {
+			nested, child.sign(t, []dns.RR{nested}),
+		},
+		// A validly signed record of another owner
+		"_redirect.victim.signed.test./TXT": {
+			attacker, parent.sign(t, []dns.RR{attacker}),
+		},
+	}
+
+	// The zone gets its own server since the default mux sends DS queries
+	// to the top-most zone, which is the "test." zone of the testing server
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't start the signed zone's server: %s", err)
+	}
+	started := make(chan struct{})
+	s := &dns.Server{
+		PacketConn:        l,
+		NotifyStartedFunc: func() { close(started) },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			q := r.Question[0]
+			if !dns.IsSubDomain("signed.test.", q.Name) {
+				handleDNSRequest(w, r)
+				return
+			}
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Answer = answers[q.Name+"/"+dns.TypeToString[q.Qtype]]
+			// Mimic a validating resolver which only authenticates signed answers
+			m.AuthenticatedData = q.Name == "_redirect.good.signed.test."
+			w.WriteMsg(m)
+		}),
+	}
+	go s.ActivateAndServe()
+	<-started
+	return parent, l.LocalAddr().String(), func() { s.Shutdown() }
+}
+
+func TestDNSSEC(t *testing.T) {
+	parent, addr, stop := RunSignedZone(t)
+	defer stop()
+
+	anchors := map[string]string{
+		"DNSKEY": parent.key.String(),
+		"DS":     parent.key.ToDS(dns.SHA256).String(),
+	}
+	tests := []struct {
+		zone  string
+		mode  string
+		valid bool
+	}{
+		{"_redirect.good.signed.test.", "validate", true},
+		{"_redirect.nested.child.signed.test.", "validate", true},
+		{"_redirect.bogus.signed.test.", "validate", false},
+		{"_redirect.unsigned.signed.test.", "validate", false},
+		{"_redirect.about.test.", "validate", false},
+		{"_redirect.victim.signed.test.", "validate", false},
+		{"_redirect.victim.signed.test.", "", false},
+		{"_redirect.good.signed.test.", "ad", true},
+		{"_redirect.bogus.signed.test.", "ad", false},
+		{"_redirect.about.test.", "ad", false},
+		{"_redirect.about.test.", "", true},
+	}
+	for anchorType, anchor := range anchors {
+		for _, test := range tests {
+			c := Config{
+				Resolver: addr,
+				DNSSEC: DNSSEC{
+					Mode:         test.mode,
+					TrustAnchors: []string{anchor},
+				},
+			}
+			_, err := query(test.zone, context.Background(), c)
+			if test.valid && err != nil {
+				t.Errorf("%s anchor: Expected %s to be valid in %q mode, got error: %s", anchorType, test.zone, test.mode, err)
+			}
+			if !test.valid && err == nil {
+				t.Errorf("%s anchor: Expected %s to be refused in %q mode", anchorType, test.zone, test.mode)
+			}
+		}
+	}
+}
+
+func TestDNSSECFallback(t *testing.T) {
+	_, addr, stop := RunSignedZone(t)
+	defer stop()
+
+	c := Config{
+		Resolver: addr,
+		Enable:   []string{"host"},
+		Redirect: "https://fallback.test",
+		DNSSEC: DNSSEC{
+			Mode: "ad",
+		},
+	}
+	for host, location := range map[string]string{
+		"good.signed.test":  "https://good.signed.test",
+		"bogus.signed.test": c.Redirect,
+	} {
+		req := httptest.NewRequest("GET", "https://"+host, nil)
+		resp := httptest.NewRecorder()
+		if err := c.Serve(resp, req); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if got := resp.Header().Get("Location"); got != location {
+			t.Errorf("Expected %s to redirect to %s, got %s", host, location, got)
+		}
+	}
+}
@@ -15,7 +15,6 @@ package minitxtd
 
 import (
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -28,15 +27,18 @@ var dockerRegexes = map[string]*regexp.Regexp{
 	"container": regexp.MustCompile("v2\\/(([\\w\\d-]+\\/?)+)\\/(tags|manifests|_catalog|blobs)"),
 }
 
-func redirectDockerv2(w http.ResponseWriter, r *http.Request, rec record) error {
+func redirectDockerv2(w http.ResponseWriter, r *http.Request, rec Record, c Config) error {
 	path := r.URL.Path
 	if !strings.HasPrefix(path, "/v2") {
-		log.Printf("[txtdirect]: unrecognized path for dockerv2: %s", path)
+		c.logger.Infof("unrecognized path for dockerv2: %s", path)
+		// Only the record's own fallbacks apply here, so the global
+		// fallback settings are left out of the config.
+		fb := Config{logger: c.logger}
 		if path == "" || path == "/" {
-			fallback(w, r, rec.Root, rec.Type, "root", http.StatusPermanentRedirect, Config{})
+			fallback(w, r, rec.Root, rec.Type, "root", http.StatusPermanentRedirect, fb)
 			return nil
 		}
-		fallback(w, r, rec.Website, rec.Type, "website", http.StatusPermanentRedirect, Config{})
+		fallback(w, r, rec.Website, rec.Type, "website", http.StatusPermanentRedirect, fb)
 		return nil
 	}
 	if dockerRegexes["v2"].MatchString(path) {
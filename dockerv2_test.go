@@ -23,12 +23,12 @@ import (
 func Test_generateDockerv2URI(t *testing.T) {
 	tests := []struct {
 		path     string
-		rec      record
+		rec      Record
 		expected string
 	}{
 		{
 			"/v2/",
-			record{
+			Record{
 				To:   "https://gcr.io/seetheprogress/txtdirect:latest",
 				Code: 302,
 			},
@@ -36,7 +36,7 @@ func Test_generateDockerv2URI(t *testing.T) {
 		},
 		{
 			"/v2/random/container/tags/latest",
-			record{
+			Record{
 				To:   "https://gcr.io/",
 				Code: 302,
 			},
@@ -44,7 +44,7 @@ func Test_generateDockerv2URI(t *testing.T) {
 		},
 		{
 			"/v2/random/container/tags/v2.0.0",
-			record{
+			Record{
 				To:   "https://gcr.io/",
 				Code: 302,
 			},
@@ -52,7 +52,7 @@ func Test_generateDockerv2URI(t *testing.T) {
 		},
 		{
 			"/v2/testing/container/tags/v3.0.0",
-			record{
+			Record{
 				To:   "https://gcr.io/testing/container:v2.0.0",
 				Code: 302,
 			},
@@ -60,7 +60,7 @@ func Test_generateDockerv2URI(t *testing.T) {
 		},
 		{
 			"/v2/testing/container/tags/v2.0.0",
-			record{
+			Record{
 				To:   "https://gcr.io/testing/container",
 				Code: 302,
 			},
@@ -68,7 +68,7 @@ func Test_generateDockerv2URI(t *testing.T) {
 		},
 		{
 			"/v2/random/container/tags/latest",
-			record{
+			Record{
 				To:   "https://gcr.io/testing/container:v2.0.0",
 				Code: 302,
 			},
@@ -77,7 +77,7 @@ func Test_generateDockerv2URI(t *testing.T) {
 
 		{
 			"/v2/random/container/tags/v2.0.0",
-			record{
+			Record{
 				To:   "https://gcr.io/testing/container",
 				Code: 302,
 			},
@@ -85,7 +85,7 @@ func Test_generateDockerv2URI(t *testing.T) {
 		},
 		{
 			"/v2/random/container/_catalog",
-			record{
+			Record{
 				To:   "https://gcr.io/",
 				Code: 302,
 			},
@@ -93,7 +93,7 @@ func Test_generateDockerv2URI(t *testing.T) {
 		},
 		{
 			"/random/path",
-			record{
+			Record{
 				To:      "https://gcr.io/",
 				Code:    302,
 				Website: "https://fallback.test",
@@ -102,7 +102,7 @@ func Test_generateDockerv2URI(t *testing.T) {
 		},
 		{
 			"",
-			record{
+			Record{
 				To:   "https://gcr.io/",
 				Code: 302,
 				Root: "https://fallback.test",
@@ -113,7 +113,7 @@ func Test_generateDockerv2URI(t *testing.T) {
 	for _, test := range tests {
 		req := httptest.NewRequest("GET", fmt.Sprintf("https://example.com%s", test.path), nil)
 		resp := httptest.NewRecorder()
-		err := redirectDockerv2(resp, req, test.rec)
+		err := redirectDockerv2(resp, req, test.rec, Config{})
 		if err != nil {
 			t.Errorf("Unexpected error happened: %s", err)
 		}
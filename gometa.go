@@ -30,7 +30,7 @@ var tmpl = template.Must(template.New("").Parse(`<!DOCTYPE html>
 
 // gometa executes a template on the given ResponseWriter
 // that contains go-import meta tag
-func gometa(w http.ResponseWriter, r record, host, path string) error {
+func gometa(w http.ResponseWriter, r Record, host, path string) error {
 	if r.Vcs == "" {
 		r.Vcs = "git"
 	}
@@ -23,13 +23,13 @@ func TestGometa(t *testing.T) {
 	tests := []struct {
 		host     string
 		path     string
-		record   record
+		record   Record
 		expected string
 	}{
 		{
 			host: "example.com",
 			path: "/testing",
-			record: record{
+			record: Record{
 				Vcs: "git",
 				To:  "redirect.com/my-go-pkg",
 			},
@@ -44,7 +44,7 @@ func TestGometa(t *testing.T) {
 		{
 			host:   "empty.com",
 			path:   "/testing",
-			record: record{},
+			record: Record{},
 			expected: `<!DOCTYPE html>
 <html>
 <head>
@@ -56,7 +56,7 @@ func TestGometa(t *testing.T) {
 		{
 			host: "root.com",
 			path: "/testing",
-			record: record{
+			record: Record{
 				Vcs: "git",
 				To:  "redirect.com/my-root-package",
 			},
@@ -71,7 +71,7 @@ func TestGometa(t *testing.T) {
 		{
 			host: "root.com",
 			path: "/testing",
-			record: record{
+			record: Record{
 				Vcs: "git",
 				To:  "github.com/txtdirect/txtdirect",
 			},
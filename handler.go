@@ -0,0 +1,51 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Handler serves the requests with its config as a plain http.Handler.
+// The config can be replaced while requests are being served.
+type Handler struct {
+	config atomic.Value
+}
+
+// NewHandler returns a handler that serves the requests with the given config
+func NewHandler(c Config) *Handler {
+	h := &Handler{}
+	h.SetConfig(c)
+	return h
+}
+
+// Config returns the config the handler is currently using
+func (h *Handler) Config() Config {
+	return h.config.Load().(Config)
+}
+
+// SetConfig replaces the config of the handler, the requests that are
+// already being served keep using the previous config
+func (h *Handler) SetConfig(c Config) {
+	h.config.Store(c)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := h.Config()
+	if err := c.Serve(w, r); err != nil {
+		c.logger.With("request_id", w.Header().Get(RequestIDHeader)).Errorf("couldn't serve %s%s: %s", r.Host, r.URL.Path, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
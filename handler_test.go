@@ -0,0 +1,61 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	source := NewStaticSource(map[string][]string{
+		"example.test": {"v=txtv1;to=https://first.test"},
+		"custom.test":  {"v=txtv1;type=custom;to=https://example.test"},
+	})
+	h := NewHandler(Config{Enable: []string{"host", "custom"}, Source: source})
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	get := func(host string) *http.Response {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		req.Host = host
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := get("example.test"); resp.Header.Get("Location") != "https://first.test" {
+		t.Errorf("Expected a redirect to https://first.test, got %s", resp.Header.Get("Location"))
+	}
+	if resp := get("custom.test"); resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected status %d for an unsupported type, got %d", http.StatusInternalServerError, resp.StatusCode)
+	}
+
+	h.SetConfig(Config{
+		Enable: []string{"host"},
+		Source: NewStaticSource(map[string][]string{"example.test": {"v=txtv1;to=https://second.test"}}),
+	})
+	if resp := get("example.test"); resp.Header.Get("Location") != "https://second.test" {
+		t.Errorf("Expected a redirect to https://second.test, got %s", resp.Header.Get("Location"))
+	}
+}
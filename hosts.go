@@ -0,0 +1,97 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// HostConfig overrides the global config for the hosts matching its
+// pattern. The pattern is either an exact host such as example.com or
+// a wildcard suffix such as *.example.com, which matches the subdomains
+// of example.com but not example.com itself. Only the set fields are
+// overridden, e.g. an empty Redirect keeps the global fallback.
+type HostConfig struct {
+	Pattern  string
+	Enable   []string
+	Redirect string
+	// Resolver replaces the global resolver and upstreams
+	Resolver string
+	// Resolvers replaces the global resolvers when it has upstreams
+	Resolvers Resolvers
+}
+
+// forHost returns the config used for the given host. An exact pattern
+// wins over the wildcards and the longest wildcard suffix wins among them.
+func (c Config) forHost(host string) Config {
+	if len(c.Hosts) == 0 {
+		return c
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var match *HostConfig
+	for i := range c.Hosts {
+		hc := &c.Hosts[i]
+		pattern := strings.ToLower(hc.Pattern)
+		if pattern == host {
+			match = hc
+			break
+		}
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(host, pattern[1:]) {
+			if match == nil || len(pattern) > len(match.Pattern) {
+				match = hc
+			}
+		}
+	}
+
+	// The merged config doesn't match again when it's served
+	merged := c
+	merged.Hosts = nil
+	if match == nil {
+		return merged
+	}
+	if match.Enable != nil {
+		merged.Enable = match.Enable
+	}
+	if match.Redirect != "" {
+		merged.Redirect = match.Redirect
+	}
+	if match.Resolver != "" {
+		// The upstreams would be preferred over the resolver
+		merged.Resolver = match.Resolver
+		merged.Resolvers.Upstreams = nil
+	}
+	if len(match.Resolvers.Upstreams) != 0 {
+		merged.Resolvers = match.Resolvers
+	}
+	return merged
+}
+
+// Validate checks the host pattern and the overridden values
+func (hc HostConfig) Validate() error {
+	pattern := strings.TrimPrefix(hc.Pattern, "*.")
+	if pattern == "" || strings.ContainsAny(pattern, "*/: ") {
+		return fmt.Errorf("invalid host pattern %q, expected a host or *.suffix", hc.Pattern)
+	}
+	c := Config{Enable: hc.Enable, Redirect: hc.Redirect, Resolvers: hc.Resolvers}
+	if err := c.Validate(); err != nil {
+		return fmt.Errorf("invalid config for %s: %s", hc.Pattern, err)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_forHost(t *testing.T) {
+	c := Config{
+		Redirect: "https://global.test",
+		Resolver: "127.0.0.1:53",
+		Hosts: []HostConfig{
+			{Pattern: "*.example.test", Redirect: "https://wildcard.test"},
+			{Pattern: "*.eu.example.test", Redirect: "https://eu.test"},
+			{Pattern: "www.eu.example.test", Resolver: "10.0.0.1:53"},
+		},
+	}
+	tests := []struct {
+		host     string
+		redirect string
+		resolver string
+	}{
+		{"example.test", "https://global.test", "127.0.0.1:53"},
+		{"a.example.test", "https://wildcard.test", "127.0.0.1:53"},
+		{"a.b.example.test", "https://wildcard.test", "127.0.0.1:53"},
+		{"A.Example.Test:8080", "https://wildcard.test", "127.0.0.1:53"},
+		{"a.eu.example.test", "https://eu.test", "127.0.0.1:53"},
+		{"www.eu.example.test", "https://global.test", "10.0.0.1:53"},
+		{"notexample.test", "https://global.test", "127.0.0.1:53"},
+	}
+	for _, test := range tests {
+		hc := c.forHost(test.host)
+		if hc.Redirect != test.redirect || hc.Resolver != test.resolver {
+			t.Errorf("Expected %s and %s for %s, got %s and %s", test.redirect, test.resolver, test.host, hc.Redirect, hc.Resolver)
+		}
+		if hc.Hosts != nil {
+			t.Errorf("Expected the overrides to be merged for %s", test.host)
+		}
+	}
+
+	c.Resolvers = Resolvers{Upstreams: []Upstream{{Address: "10.9.9.9:53"}}}
+	if hc := c.forHost("www.eu.example.test"); len(hc.Resolvers.Upstreams) != 0 {
+		t.Errorf("Expected the host's resolver to replace the upstreams, got %v", hc.Resolvers.Upstreams)
+	}
+	if hc := c.forHost("a.example.test"); len(hc.Resolvers.Upstreams) != 1 {
+		t.Errorf("Expected the global upstreams to be kept, got %v", hc.Resolvers.Upstreams)
+	}
+}
+
+func TestHostOverridesE2e(t *testing.T) {
+	c := Config{
+		Enable:   []string{"host"},
+		Redirect: "https://global.test",
+		Source: NewStaticSource(map[string][]string{
+			"a.sales.test":   {"v=txtv1;type=path;to=https://sales.test"},
+			"a.support.test": {"v=txtv1;type=path;to=https://support.test"},
+		}),
+		Hosts: []HostConfig{
+			{Pattern: "*.sales.test", Enable: []string{"host", "path"}, Redirect: "https://sales.test/404"},
+			{Pattern: "missing.support.test", Enable: []string{"host", "www"}},
+		},
+	}
+	c.SetDefaults()
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		// The path type is only enabled for sales
+		{"https://a.sales.test/", "https://sales.test"},
+		{"https://a.support.test/", "https://global.test"},
+		{"https://missing.sales.test/", "https://sales.test/404"},
+		{"https://missing.support.test/", "https://www.missing.support.test"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.URL.Host = req.Host
+		resp := httptest.NewRecorder()
+		if err := c.Serve(resp, req); err != nil {
+			t.Fatalf("Unexpected error for %s: %s", test.url, err)
+		}
+		if location := resp.Header().Get("Location"); location != test.expected {
+			t.Errorf("Expected %s to redirect to %s, got %s", test.url, test.expected, location)
+		}
+	}
+
+	// The host's resolver is used instead of the unreachable global upstream
+	c = Config{
+		Enable:    []string{"host"},
+		Redirect:  "https://global.test",
+		Resolvers: Resolvers{Upstreams: []Upstream{{Address: "127.0.0.1:1", Timeout: 100 * time.Millisecond}}},
+		Hosts:     []HostConfig{{Pattern: "about.test", Resolver: "127.0.0.1:" + strconv.Itoa(port)}},
+	}
+	c.SetDefaults()
+	req := httptest.NewRequest("GET", "https://about.test", nil)
+	resp := httptest.NewRecorder()
+	if err := c.Serve(resp, req); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if location := resp.Header().Get("Location"); location != "https://about.txtdirect.org" {
+		t.Errorf("Expected the host's resolver to be used, got %s", location)
+	}
+}
+
+func TestHostConfigValidate(t *testing.T) {
+	for _, hc := range []HostConfig{
+		{Pattern: ""},
+		{Pattern: "*."},
+		{Pattern: "a.*.example.test"},
+		{Pattern: "example.test:80"},
+		{Pattern: "example.test", Enable: []string{"ftp"}},
+		{Pattern: "example.test", Redirect: "example.org"},
+	} {
+		if err := (Config{Hosts: []HostConfig{hc}}).Validate(); err == nil {
+			t.Errorf("Expected an error for %+v", hc)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// recordKeys are the keys TXTDirect understands
+var recordKeys = []string{
+	"code", "from", "from-time", "priority", "re", "ref", "root", "sticky",
+	"to", "type", "until-time", "v", "vcs", "weight", "when", "website",
+}
+
+// recordTypes are the record types TXTDirect can serve
+var recordTypes = []string{"dockerv2", "gometa", "gomods", "host", "path", "proxy"}
+
+var (
+	// placeholderLikeRegex matches anything that looks like a placeholder
+	placeholderLikeRegex  = regexp.MustCompile("{[^{}]*}")
+	validPlaceholderRegex = regexp.MustCompile(
+		"^{(uri|dir|file|host|hostonly|method|path|path_escaped|port|query|query_escaped|ua_class|uri_escaped|user|label[1-9][0-9]*|[>~?][\\w-]+|\\$[1-9][0-9]*)}$",
+	)
+)
+
+// LintProblem is a problem found in a TXT record
+type LintProblem struct {
+	Zone    string
+	Record  string
+	Message string
+}
+
+func (p LintProblem) String() string {
+	if p.Zone == "" {
+		return fmt.Sprintf("%s: %s", p.Record, p.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", p.Zone, p.Record, p.Message)
+}
+
+// LintRecord checks the TXT record for mistakes that would only show up
+// when a request is served. The record's type is checked against the
+// enabled types of the given config.
+func LintRecord(txt string, c Config) []string {
+	pairs, err := splitRecord(txt)
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var problems []string
+	values := make(map[string]string)
+	for _, p := range pairs {
+		if p.key == "" {
+			// txtv0 pairs without a key are reported by the parser
+			continue
+		}
+		if !contains(recordKeys, p.key) {
+			problems = append(problems, fmt.Sprintf("unknown key %s", p.key))
+		}
+		if _, ok := values[p.key]; !ok {
+			values[p.key] = p.value
+		}
+		if p.key == "re" || p.key == "v" {
+			continue
+		}
+		for _, placeholder := range placeholderLikeRegex.FindAllString(p.value, -1) {
+			if !validPlaceholderRegex.MatchString(placeholder) {
+				problems = append(problems, fmt.Sprintf("invalid placeholder %s in %s=", placeholder, p.key))
+			}
+		}
+	}
+
+	recType, ok := values["type"]
+	if !ok {
+		recType = "host"
+	}
+	switch {
+	case !contains(recordTypes, recType):
+		problems = append(problems, fmt.Sprintf("unknown type %s", recType))
+	case len(c.Enable) != 0 && !contains(c.Enable, recType):
+		problems = append(problems, fmt.Sprintf("type %s is not enabled", recType))
+	}
+
+	_, hasRe := values["re"]
+	_, hasFrom := values["from"]
+	if hasRe && hasFrom {
+		problems = append(problems, "re= and from= can't be used in the same record")
+	}
+	if re, ok := values["re"]; ok {
+		if _, err := regexp.Compile(re); err != nil {
+			problems = append(problems, fmt.Sprintf("invalid regex in re=: %s", err))
+		}
+	}
+	if code, ok := values["code"]; ok {
+		if i, err := strconv.Atoi(code); err == nil && !isRedirectCode(i) {
+			problems = append(problems, fmt.Sprintf("code %d is not a redirect status code", i))
+		}
+	}
+
+	// Referencing records may get their to= from the referenced record
+	_, hasRef := values["ref"]
+	if _, err := ParseRecord(txt); err != nil {
+		if err != errDockerv2Target {
+			problems = append(problems, err.Error())
+		} else if !hasRef {
+			problems = append(problems, "type dockerv2 requires a to= key")
+		}
+	}
+	return problems
+}
+
+// LintSource checks the TXT records of the redirect zones in the source.
+// The other names of a zone file, such as the SPF or site verification
+// records of the apex, aren't TXTDirect records.
+func LintSource(s StaticSource, c Config) []LintProblem {
+	zones := make([]string, 0, len(s))
+	for zone := range s {
+		if strings.HasPrefix(zone, basezone+".") {
+			zones = append(zones, zone)
+		}
+	}
+	sort.Strings(zones)
+
+	var problems []LintProblem
+	for _, zone := range zones {
+		problems = append(problems, lintZone(zone, s[zone], c)...)
+	}
+	return problems
+}
+
+// LintHost looks up the TXT records of the host and checks them
+func LintHost(host string, ctx context.Context, c Config) ([]LintProblem, error) {
+	txts, err := lookup(host, ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	return lintZone(absoluteZone(host), txts, c), nil
+}
+
+func lintZone(zone string, txts []string, c Config) []LintProblem {
+	var problems []LintProblem
+	for _, txt := range txts {
+		// Ignore the other TXT records of the zone, e.g. SPF records
+		if len(txts) > 1 && recordVersion(txt) < 0 {
+			continue
+		}
+		for _, msg := range LintRecord(txt, c) {
+			problems = append(problems, LintProblem{Zone: zone, Record: txt, Message: msg})
+		}
+	}
+	return problems
+}
+
+func isRedirectCode(code int) bool {
+	switch code {
+	case 301, 302, 303, 307, 308:
+		return true
+	}
+	return false
+}
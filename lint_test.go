@@ -0,0 +1,99 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestLintRecord(t *testing.T) {
+	c := Config{Enable: []string{"host", "path", "dockerv2"}}
+	tests := []struct {
+		txt      string
+		expected []string
+	}{
+		{"v=txtv1;to=https://example.test/{path}?q={?q}&l={label1};code=301", nil},
+		{"v=txtv0;type=path;re=^/(.*);to=https://example.test/{$1}", nil},
+		{"v=txtv0;to=https://example.test;foo=bar", []string{"unknown key foo"}},
+		{"v=txtv0;to=https://example.test;junk", []string{"arbitrary data not allowed"}},
+		{"v=txtv1;type=gometa;to=https://example.test", []string{"type gometa is not enabled"}},
+		{"v=txtv1;type=unknown;to=https://example.test", []string{"unknown type unknown"}},
+		{"v=txtv1;type=path;re=/(.*);from=/$1", []string{"re= and from= can't be used in the same record"}},
+		{"v=txtv1;type=path;re=(", []string{"invalid regex in re=: error parsing regexp: missing closing ): `(`"}},
+		{"v=txtv1;to=https://example.test/{pth}{label0}", []string{"invalid placeholder {pth} in to=", "invalid placeholder {label0} in to="}},
+		{"v=txtv1;to=https://example.test;code=200", []string{"code 200 is not a redirect status code"}},
+		{"v=txtv1;to=https://example.test;code=abc", []string{"could not parse status code: strconv.Atoi: parsing \"abc\": invalid syntax"}},
+		{"v=txtv1;type=dockerv2", []string{"type dockerv2 requires a to= key"}},
+		{"v=txtv1;type=dockerv2;ref=_redirect.shared.test", nil},
+		{"v=txtv1;to=\"https://example.test", []string{"syntax error at offset 11: unterminated quoted value"}},
+	}
+	for _, test := range tests {
+		problems := LintRecord(test.txt, c)
+		if !reflect.DeepEqual(problems, test.expected) {
+			t.Errorf("Expected %q for %s, got %q", test.expected, test.txt, problems)
+		}
+	}
+}
+
+func TestLintSource(t *testing.T) {
+	source := NewStaticSource(map[string][]string{
+		"example.test":   {"v=txtv1;to=https://example.test", "v=spf1 -all"},
+		"b.example.test": {"v=txtv1;to=https://example.test;code=200"},
+		"a.example.test": {"v=txtv1;type=gometa"},
+	})
+	c := Config{Enable: []string{"host"}, Source: source}
+
+	expected := []LintProblem{
+		{"_redirect.a.example.test.", "v=txtv1;type=gometa", "type gometa is not enabled"},
+		{"_redirect.b.example.test.", "v=txtv1;to=https://example.test;code=200", "code 200 is not a redirect status code"},
+	}
+	if problems := LintSource(source, c); !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Expected %v, got %v", expected, problems)
+	}
+
+	problems, err := LintHost("b.example.test", context.Background(), c)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(problems) != 1 || problems[0] != expected[1] {
+		t.Errorf("Expected %v, got %v", expected[1:], problems)
+	}
+}
+
+const testLintZoneFile = `$ORIGIN lint.test.
+@          3600 IN TXT "v=spf1 include:_spf.google.com ~all"
+@          3600 IN TXT "google-site-verification=abc123"
+www        3600 IN TXT "v=spf1 -all"
+_dmarc     3600 IN TXT "v=DMARC1; p=reject"
+_redirect  3600 IN TXT "v=txtv1;to=https://example.test"
+_redirect.docs 3600 IN TXT "v=txtv1;to=https://docs.test;code=200"
+`
+
+func TestLintZoneFile(t *testing.T) {
+	path, cleanup := writeTestFile(t, "lint.test.zone", testLintZoneFile)
+	defer cleanup()
+
+	source, err := NewZoneFileSource(path, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []LintProblem{
+		{"_redirect.docs.lint.test.", "v=txtv1;to=https://docs.test;code=200", "code 200 is not a redirect status code"},
+	}
+	if problems := LintSource(source, Config{Enable: []string{"host"}}); !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Expected %v, got %v", expected, problems)
+	}
+}
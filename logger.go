@@ -0,0 +1,342 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Log levels of the structured logger
+const (
+	LevelDebug = "debug"
+	LevelInfo  = "info"
+	LevelWarn  = "warn"
+	LevelError = "error"
+)
+
+var logLevels = map[string]int{LevelDebug: 0, LevelInfo: 1, LevelWarn: 2, LevelError: 3}
+
+// Logger writes the log events as JSON lines. The methods of a nil
+// Logger write plain lines with the standard logger.
+type Logger struct {
+	sink   *logSink
+	level  int
+	fields map[string]interface{}
+}
+
+// logSink is the output shared by a logger and its derived loggers
+type logSink struct {
+	sync.Mutex
+	out io.Writer
+	// closer closes the log file, the standard streams aren't closed
+	closer io.Closer
+	closed bool
+}
+
+// LogRotate configures the rotation of the log file. The file is rotated
+// when it reaches MaxSize megabytes, 100 by default, and the rotated files
+// are removed when they're older than MaxAge days or when there are more
+// than MaxBackups of them. The zero values keep every rotated file.
+type LogRotate struct {
+	MaxSize    int  `yaml:"max_size"`
+	MaxAge     int  `yaml:"max_age"`
+	MaxBackups int  `yaml:"max_backups"`
+	Compress   bool `yaml:"compress"`
+}
+
+// NewLogger returns a logger that writes the events at or above the given
+// level to the output, which is stdout, stderr or the path of a file that
+// is rotated with the given options
+func NewLogger(output, level string, rotate LogRotate) (*Logger, error) {
+	if level == "" {
+		level = LevelInfo
+	}
+	l, ok := logLevels[level]
+	if !ok {
+		return nil, fmt.Errorf("unknown log level %s, expected debug, info, warn or error", level)
+	}
+
+	switch output {
+	case "stdout":
+		return newLogger(os.Stdout, l), nil
+	case "stderr", "":
+		return newLogger(os.Stderr, l), nil
+	default:
+		// The rotated file is only opened on the first event, so the
+		// errors are reported here instead of being dropped later
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't open the log file: %s", err)
+		}
+		f.Close()
+		out := &lumberjack.Logger{
+			Filename:   output,
+			MaxSize:    rotate.MaxSize,
+			MaxAge:     rotate.MaxAge,
+			MaxBackups: rotate.MaxBackups,
+			Compress:   rotate.Compress,
+		}
+		logger := newLogger(out, l)
+		logger.sink.closer = out
+		return logger, nil
+	}
+}
+
+func newLogger(out io.Writer, level int) *Logger {
+	return &Logger{sink: &logSink{out: out}, level: level}
+}
+
+// Close closes the log file of the logger. The events that are logged
+// afterwards, e.g. by the requests that were being served when the
+// config got reloaded, are written with the standard logger.
+func (l *Logger) Close() error {
+	if l == nil || l.sink == nil {
+		return nil
+	}
+	l.sink.Lock()
+	defer l.sink.Unlock()
+	if l.sink.closed || l.sink.closer == nil {
+		return nil
+	}
+	l.sink.closed = true
+	return l.sink.closer.Close()
+}
+
+// With returns a logger that adds the field to all of its events. The
+// derived logger of a nil Logger adds the field to the plain lines.
+func (l *Logger) With(key string, value interface{}) *Logger {
+	derived := &Logger{}
+	if l != nil {
+		*derived = *l
+	}
+	derived.fields = l.merge(map[string]interface{}{key: value})
+	return derived
+}
+
+// structured checks if the logger writes JSON events
+func (l *Logger) structured() bool {
+	return l != nil && l.sink != nil
+}
+
+// merge returns the logger's fields together with the given fields
+func (l *Logger) merge(fields map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(fields)+3)
+	if l != nil {
+		for k, v := range l.fields {
+			merged[k] = v
+		}
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return merged
+}
+
+// Log writes the event with the given fields
+func (l *Logger) Log(level, msg string, fields map[string]interface{}) {
+	event := l.merge(fields)
+	if !l.structured() {
+		keys := make([]string, 0, len(event))
+		for k := range event {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			msg += fmt.Sprintf(" %s=%v", k, event[k])
+		}
+		log.Printf("[txtdirect]: %s", msg)
+		return
+	}
+	if logLevels[level] < l.level {
+		return
+	}
+
+	event["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	event["level"] = level
+	event["msg"] = msg
+	line, err := json.Marshal(event)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{"level": LevelError, "msg": "couldn't encode the log event: " + err.Error()})
+	}
+
+	l.sink.Lock()
+	defer l.sink.Unlock()
+	if l.sink.closed {
+		log.Print(string(line))
+		return
+	}
+	l.sink.out.Write(append(line, '\n'))
+}
+
+func (l *Logger) logf(level, format string, args ...interface{}) {
+	l.Log(level, fmt.Sprintf(format, args...), nil)
+}
+
+// Debugf logs the message at the debug level
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(LevelDebug, format, args...)
+}
+
+// Infof logs the message at the info level
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(LevelInfo, format, args...)
+}
+
+// Warnf logs the message at the warn level
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(LevelWarn, format, args...)
+}
+
+// Errorf logs the message at the error level
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(LevelError, format, args...)
+}
+
+// SetupLogger creates the structured logger of the config when the
+// LogOutput is set, otherwise the standard logger keeps being used
+func (c *Config) SetupLogger() error {
+	if c.LogOutput == "" || c.logger != nil {
+		return nil
+	}
+	l, err := NewLogger(c.LogOutput, c.LogLevel, c.LogRotate)
+	if err != nil {
+		return err
+	}
+	c.logger = l
+	return nil
+}
+
+// requestLog collects the decision of a request for its log event
+type requestLog struct {
+	recordType string
+	zone       string
+	target     string
+	fallback   string
+	traced     bool
+}
+
+type requestLogKey struct{}
+
+func requestLogFrom(ctx context.Context) *requestLog {
+	l, _ := ctx.Value(requestLogKey{}).(*requestLog)
+	return l
+}
+
+func (l *requestLog) setZone(zone string) {
+	if l != nil {
+		l.zone = zone
+	}
+}
+
+func (l *requestLog) setType(recordType string) {
+	if l != nil {
+		l.recordType = recordType
+	}
+}
+
+func (l *requestLog) setFallback(fallbackType string) {
+	if l != nil {
+		l.fallback = fallbackType
+	}
+}
+
+func (l *requestLog) setTarget(target string) {
+	if l != nil {
+		l.target = target
+	}
+}
+
+// serveLogged serves the request and logs its decision
+func (c Config) serveLogged(w http.ResponseWriter, r *http.Request) error {
+	start := time.Now()
+	rl := &requestLog{}
+	sw := &statusWriter{ResponseWriter: w}
+	err := c.serve(sw, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl)))
+
+	status := sw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if rl.target == "" {
+		rl.target = sw.Header().Get("Location")
+	}
+	fields := map[string]interface{}{
+		"host":       r.Host,
+		"path":       r.URL.Path,
+		"type":       rl.recordType,
+		"zone":       rl.zone,
+		"target":     rl.target,
+		"status":     status,
+		"fallback":   rl.fallback,
+		"latency_ms": float64(time.Since(start)) / float64(time.Millisecond),
+	}
+	level := LevelInfo
+	if err != nil {
+		level = LevelError
+		fields["error"] = err.Error()
+	}
+	msg := "decision"
+	if rl.traced {
+		msg = "trace"
+	}
+	c.logger.Log(level, msg, fields)
+	return err
+}
+
+// statusWriter keeps the status code of the response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("the response writer doesn't support hijacking")
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	path, cleanup := writeTestFile(t, "txtdirect.log", "")
+	defer cleanup()
+
+	l, err := NewLogger(path, LevelWarn, LogRotate{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	l.Infof("dropped")
+	l.Warnf("kept %d", 1)
+	l.Log(LevelError, "event", map[string]interface{}{"host": "example.test"})
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Couldn't read the log file: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 events, got %q", lines)
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil || event["level"] != "warn" || event["msg"] != "kept 1" {
+		t.Errorf("Unexpected event %s: %v", lines[0], err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &event); err != nil || event["level"] != "error" || event["host"] != "example.test" {
+		t.Errorf("Unexpected event %s: %v", lines[1], err)
+	}
+
+	if _, err := NewLogger("stdout", "verbose", LogRotate{}); err == nil {
+		t.Errorf("Expected an error for an unknown level")
+	}
+	if _, err := NewLogger("/nonexistent/txtdirect.log", "", LogRotate{}); err == nil {
+		t.Errorf("Expected an error for an unwritable file")
+	}
+}
+
+func TestLoggerWith(t *testing.T) {
+	var buf bytes.Buffer
+	l := newLogger(&buf, logLevels[LevelInfo])
+	l.With("request_id", "42").Infof("derived")
+	l.Infof("parent")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"request_id":"42"`) || strings.Contains(lines[1], "request_id") {
+		t.Errorf("Expected only the derived logger to add the field, got %q", lines)
+	}
+
+	// The derived logger of a nil Logger writes plain lines
+	buf.Reset()
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	var plain *Logger
+	plain.With("request_id", "42").Warnf("couldn't %s", "serve")
+	if !strings.HasSuffix(buf.String(), "[txtdirect]: couldn't serve request_id=42\n") {
+		t.Errorf("Unexpected plain line %q", buf.String())
+	}
+}
+
+func TestLoggerRotation(t *testing.T) {
+	path, cleanup := writeTestFile(t, "txtdirect.log", "")
+	defer cleanup()
+
+	l, err := NewLogger(path, "", LogRotate{MaxSize: 1, MaxBackups: 1})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	// Three megabytes of events rotate the file at least twice
+	msg := strings.Repeat("x", 1024)
+	for i := 0; i < 3*1024; i++ {
+		l.Infof(msg)
+	}
+
+	// lumberjack removes the old backups in the background
+	waitFor(t, func() bool {
+		backups, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "txtdirect-*.log"))
+		return len(backups) == 1
+	})
+	info, err := os.Stat(path)
+	if err != nil || info.Size() > 1024*1024 {
+		t.Errorf("Expected the log file to be rotated, got %v: %v", info, err)
+	}
+}
+
+func TestDecisionLogE2e(t *testing.T) {
+	var buf bytes.Buffer
+	c := Config{
+		Enable:   []string{"host", "path", "proxy"},
+		Redirect: "https://fallback.test",
+		Source: NewStaticSource(map[string][]string{
+			"example.test":              {"v=txtv1;to=https://target.test;code=301"},
+			"path.test":                 {"v=txtv1;type=path;to=https://path.test"},
+			"_redirect.docs.path.test":  {"v=txtv1;to=https://docs.test"},
+			"_redirect._.wildcard.test": {"v=txtv1;to=https://wildcard.test"},
+		}),
+		logger: newLogger(&buf, logLevels[LevelInfo]),
+	}
+	tests := []struct {
+		url      string
+		expected map[string]interface{}
+	}{
+		{
+			"https://example.test/a",
+			map[string]interface{}{
+				"host": "example.test", "path": "/a", "type": "host", "zone": "_redirect.example.test.",
+				"target": "https://target.test", "status": 301.0, "fallback": "",
+			},
+		},
+		{
+			"https://path.test/docs",
+			map[string]interface{}{
+				"host": "path.test", "path": "/docs", "type": "host", "zone": "_redirect.docs.path.test.",
+				"target": "https://docs.test", "status": 302.0, "fallback": "",
+			},
+		},
+		{
+			"https://a.wildcard.test",
+			map[string]interface{}{
+				"host": "a.wildcard.test", "type": "host", "zone": "_redirect._.wildcard.test.",
+				"target": "https://wildcard.test", "status": 302.0,
+			},
+		},
+		{
+			"https://missing.test",
+			map[string]interface{}{
+				"host": "missing.test", "type": "", "zone": "",
+				"target": "https://fallback.test", "status": 301.0, "fallback": "redirect",
+			},
+		},
+	}
+	for _, test := range tests {
+		buf.Reset()
+		req := httptest.NewRequest("GET", test.url, nil)
+		resp := httptest.NewRecorder()
+		if err := c.Serve(resp, req); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		var event map[string]interface{}
+		decisions := 0
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var e map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatalf("Couldn't decode %s: %s", line, err)
+			}
+			if e["msg"] == "decision" {
+				event = e
+				decisions++
+			}
+		}
+		if decisions != 1 {
+			t.Fatalf("Expected a single decision for %s, got %s", test.url, buf.String())
+		}
+		if event["level"] != "info" {
+			t.Errorf("Expected an info event for %s, got %v", test.url, event["level"])
+		}
+		if _, ok := event["latency_ms"].(float64); !ok {
+			t.Errorf("Expected the latency for %s, got %v", test.url, event)
+		}
+		for k, v := range test.expected {
+			if event[k] != v {
+				t.Errorf("Expected %s=%v for %s, got %v", k, v, test.url, event[k])
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxStringLength is the maximum length of a single character-string
+// of a TXT record. Longer records have to be split into several strings.
+const MaxStringLength = 255
+
+// String returns the canonical TXT record content of the record.
+// Parsing the content of a record returned by ParseRecord gives the same
+// record back. The records that are built by hand round-trip as well when
+// they set a Version, a Code and a Type, and their To is the first
+// non-empty target.
+func (r Record) String() string {
+	return joinRecord(r.pairs())
+}
+
+// Warnings returns the problems of the record's content that don't make
+// it invalid, e.g. when it has to be split into several character-strings
+func (r Record) Warnings() []string {
+	var warnings []string
+	if n := len(r.String()); n > MaxStringLength {
+		warnings = append(warnings, fmt.Sprintf("the record is %d bytes long and has to be split into character-strings of at most %d bytes", n, MaxStringLength))
+	}
+	return warnings
+}
+
+// MarshalText returns the canonical TXT record content of the record.
+// It doesn't report the record's Warnings, the callers check them.
+func (r Record) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText parses the TXT record content into the record
+func (r *Record) UnmarshalText(text []byte) error {
+	rec, err := ParseRecord(string(text))
+	if err != nil {
+		return err
+	}
+	*r = rec
+	return nil
+}
+
+// pairs returns the record's keys in the canonical order. txtv0 records
+// are upgraded to txtv1 when one of their values can't be used in txtv0.
+func (r Record) pairs() []recordPair {
+	var pairs []recordPair
+	add := func(key, value string) {
+		if value != "" {
+			pairs = append(pairs, recordPair{key: key, value: value})
+		}
+	}
+
+	version := r.Version
+	if version == "" {
+		version = "txtv1"
+	}
+	add("v", version)
+	add("type", r.Type)
+	targets := r.Targets
+	if len(targets) == 0 && r.To != "" {
+		targets = []string{r.To}
+	}
+	// Empty targets are kept since they're targets of the parsed record
+	for _, to := range targets {
+		pairs = append(pairs, recordPair{key: "to", value: to})
+	}
+	if len(r.Weights) != 0 {
+		weights := make([]string, len(r.Weights))
+		for i, w := range r.Weights {
+			weights[i] = strconv.Itoa(w)
+		}
+		add("weight", strings.Join(weights, ","))
+	}
+	add("sticky", r.Sticky)
+	if r.Code != 0 {
+		add("code", strconv.Itoa(r.Code))
+	}
+	add("root", r.Root)
+	add("from", r.From)
+	add("re", r.Re)
+	add("vcs", r.Vcs)
+	add("website", r.Website)
+	if r.Priority != 0 {
+		add("priority", strconv.Itoa(r.Priority))
+	}
+	if !r.FromTime.IsZero() {
+		add("from-time", r.FromTime.UTC().Format(time.RFC3339))
+	}
+	if !r.UntilTime.IsZero() {
+		add("until-time", r.UntilTime.UTC().Format(time.RFC3339))
+	}
+	add("when", r.When)
+	return upgradeVersion(pairs)
+}
+
+// SplitTXT splits the TXT record content into character-strings
+// that fit in the DNS limits
+func SplitTXT(txt string) []string {
+	var strs []string
+	for len(txt) > MaxStringLength {
+		strs = append(strs, txt[:MaxStringLength])
+		txt = txt[MaxStringLength:]
+	}
+	return append(strs, txt)
+}
@@ -0,0 +1,207 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+// generatedRecord is a random record as returned by ParseRecord for the
+// round-trip tests. Its values may be empty and its version is txtv0 or
+// txtv1, the values of txtv0 records don't contain ";" since it can only
+// be used in txtv1 records.
+type generatedRecord struct {
+	Record
+}
+
+func (generatedRecord) Generate(rand *rand.Rand, size int) reflect.Value {
+	version := []string{"txtv0", "txtv1"}[rand.Intn(2)]
+	value := func() string {
+		chars := "abcXYZ019:/.?&=;\"%\\ -_{}"
+		if version == "txtv0" {
+			chars = strings.Replace(chars, ";", "", -1)
+		}
+		b := make([]byte, rand.Intn(size+1))
+		for i := range b {
+			b[i] = chars[rand.Intn(len(chars))]
+		}
+		return string(b)
+	}
+	pick := func(values ...string) string {
+		return values[rand.Intn(len(values))]
+	}
+	timestamp := func() time.Time {
+		if rand.Intn(2) == 0 {
+			return time.Time{}
+		}
+		return time.Unix(946684800+rand.Int63n(3e9), 0).UTC()
+	}
+
+	rec := Record{
+		Version:   version,
+		Code:      []int{301, 302, 307, 308}[rand.Intn(4)],
+		Type:      pick("host", "path", "gometa", "dockerv2"),
+		From:      pick("", value()),
+		Root:      pick("", value()),
+		Re:        pick("", value()),
+		Vcs:       pick("", "git", "hg"),
+		Website:   pick("", value()),
+		Priority:  rand.Intn(3) - 1,
+		Sticky:    pick("", "cookie", "ip"),
+		FromTime:  timestamp(),
+		UntilTime: timestamp(),
+		When:      pick("", "{method}==GET", "{ua_class}!=bot,{path}^=/api"),
+	}
+	for i := 0; i < rand.Intn(4); i++ {
+		to := value()
+		if rec.To == "" {
+			rec.To = to
+		}
+		rec.Targets = append(rec.Targets, to)
+	}
+	// dockerv2 records need a target
+	if rec.Type == "dockerv2" && rec.To == "" {
+		rec.To = "https://registry.test"
+		rec.Targets = append(rec.Targets, rec.To)
+	}
+	if len(rec.Targets) != 0 && rand.Intn(2) == 0 {
+		for range rec.Targets {
+			rec.Weights = append(rec.Weights, 1+rand.Intn(100))
+		}
+	}
+	return reflect.ValueOf(generatedRecord{rec})
+}
+
+func TestRecordRoundTrip(t *testing.T) {
+	roundTrip := func(g generatedRecord) bool {
+		txt, err := g.Record.MarshalText()
+		if err != nil {
+			t.Errorf("Unexpected error for %+v: %s", g.Record, err)
+			return false
+		}
+		rec, err := ParseRecord(string(txt))
+		if err != nil {
+			t.Errorf("Couldn't parse %s: %s", txt, err)
+			return false
+		}
+		if !reflect.DeepEqual(rec, g.Record) {
+			t.Errorf("Expected %+v for %s, got %+v", g.Record, txt, rec)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 1000}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRecordRoundTripDefaults(t *testing.T) {
+	for _, txt := range []string{
+		"v=txtv1",
+		"v=txtv1;to=",
+		"v=txtv1;to=;to=https://b.test",
+		"v=txtv0;to=https://a.test",
+		"v=txtv0;type=path;website=",
+		"v=txtv1;to=https://a.test;code=0",
+	} {
+		rec, err := ParseRecord(txt)
+		if err != nil {
+			t.Fatalf("Couldn't parse %s: %s", txt, err)
+		}
+		parsed, err := ParseRecord(rec.String())
+		if err != nil {
+			t.Fatalf("Couldn't parse %s: %s", rec.String(), err)
+		}
+		if !reflect.DeepEqual(parsed, rec) {
+			t.Errorf("Expected %+v for %s, got %+v from %s", rec, txt, parsed, rec.String())
+		}
+	}
+}
+
+func TestRecordWarnings(t *testing.T) {
+	rec := Record{Version: "txtv1", To: "https://example.test", Type: "host", Code: 302}
+	if warnings := rec.Warnings(); len(warnings) != 0 {
+		t.Errorf("Expected no warnings, got %q", warnings)
+	}
+	rec.To += "/" + strings.Repeat("a", MaxStringLength)
+	if warnings := rec.Warnings(); len(warnings) != 1 || !strings.Contains(warnings[0], "split into character-strings") {
+		t.Errorf("Expected a warning for the long record, got %q", warnings)
+	}
+
+	// Encoding the record, e.g. in a trace, doesn't log the warnings
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	if _, err := json.Marshal(rec); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing to be logged, got %s", buf.String())
+	}
+}
+
+func TestRecordString(t *testing.T) {
+	tests := []struct {
+		rec      Record
+		expected string
+	}{
+		{
+			Record{Version: "txtv0", To: "https://example.test", Code: 301, Type: "host"},
+			"v=txtv0;type=host;to=https://example.test;code=301",
+		},
+		{
+			Record{Version: "txtv0", To: "https://example.test/?a=1;b=2", Type: "host"},
+			`v=txtv1;type=host;to="https://example.test/?a=1;b=2"`,
+		},
+		{
+			Record{
+				Targets:  []string{"https://a.test", "https://b.test"},
+				Weights:  []int{3, 1},
+				Sticky:   "ip",
+				Code:     302,
+				Type:     "host",
+				FromTime: time.Date(2019, 6, 1, 14, 0, 0, 0, time.FixedZone("CEST", 2*60*60)),
+			},
+			"v=txtv1;type=host;to=https://a.test;to=https://b.test;weight=3,1;sticky=ip;code=302;from-time=2019-06-01T12:00:00Z",
+		},
+	}
+	for _, test := range tests {
+		if txt := test.rec.String(); txt != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, txt)
+		}
+	}
+}
+
+func TestSplitTXT(t *testing.T) {
+	rec := Record{Version: "txtv1", To: "https://example.test/" + strings.Repeat("a", 300), Type: "host", Code: 302}
+	txt, _ := rec.MarshalText()
+	strs := SplitTXT(string(txt))
+	if len(strs) != 2 || len(strs[0]) != MaxStringLength || strings.Join(strs, "") != string(txt) {
+		t.Errorf("Unexpected split of %d bytes: %q", len(txt), strs)
+	}
+
+	var parsed Record
+	if err := parsed.UnmarshalText([]byte(strings.Join(strs, ""))); err != nil || parsed.To != rec.To {
+		t.Errorf("Expected %s, got %s: %v", rec.To, parsed.To, err)
+	}
+}
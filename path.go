@@ -16,13 +16,11 @@ package minitxtd
 import (
 	"context"
 	"fmt"
-	"log"
 	"net/http"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
-	"time"
 )
 
 var PathRegex = regexp.MustCompile("\\/([A-Za-z0-9-._~!$'()*+,;=:@]+)")
@@ -33,7 +31,7 @@ var GroupOrderRegex = regexp.MustCompile("P<([a-zA-Z]+[a-zA-Z0-9]*)>")
 // zoneFromPath generates a DNS zone with the given host and path
 // It will use custom regex to parse the path if it's provided in
 // the given record.
-func zoneFromPath(host string, path string, rec record) (string, int, []string, error) {
+func zoneFromPath(host string, path string, rec Record, c Config) (string, int, []string, error) {
 	if strings.ContainsAny(path, ".") {
 		path = strings.Replace(path, ".", "-", -1)
 	}
@@ -41,10 +39,13 @@ func zoneFromPath(host string, path string, rec record) (string, int, []string,
 	if rec.Re != "" {
 		CustomRegex, err := regexp.Compile(rec.Re)
 		if err != nil {
-			log.Printf("<%s> [txtdirect]: the given regex doesn't work as expected: %s", time.Now().String(), rec.Re)
+			return "", 0, []string{}, fmt.Errorf("the given regex doesn't work as expected: %s", rec.Re)
 		}
 		pathSubmatchs = CustomRegex.FindAllStringSubmatch(path, -1)
 		if GroupRegex.MatchString(rec.Re) {
+			if len(pathSubmatchs) == 0 {
+				return "", 0, []string{}, fmt.Errorf("custom regex doesn't work on %s", path)
+			}
 			pathSlice := []string{}
 			unordered := make(map[string]string)
 			for _, item := range pathSubmatchs[0] {
@@ -67,7 +68,7 @@ func zoneFromPath(host string, path string, rec record) (string, int, []string,
 		pathSlice = append(pathSlice, v[1])
 	}
 	if len(pathSlice) < 1 && rec.Re != "" {
-		log.Printf("<%s> [txtdirect]: custom regex doesn't work on %s", time.Now().String(), path)
+		c.logger.Debugf("custom regex doesn't work on %s", path)
 	}
 	from := len(pathSlice)
 	if rec.From != "" {
@@ -109,29 +110,44 @@ func zoneFromPath(host string, path string, rec record) (string, int, []string,
 
 // getFinalRecord finds the final TXT record for the given zone.
 // It will try wildcards if the first zone return error
-func getFinalRecord(zone string, from int, ctx context.Context, c Config, r *http.Request, pathSlice []string) (record, error) {
-	txts, err := query(zone, ctx, c)
-	if err != nil {
+func getFinalRecord(zone string, from int, ctx context.Context, c Config, r *http.Request, pathSlice []string) (Record, error) {
+	txts, err := lookup(zone, ctx, c)
+	// Records out of their time window or with conditions that don't
+	// match the request are treated as absent
+	txts = activeRecords(txts, r)
+	if err != nil || len(txts) == 0 {
 		// if nothing found, jump into wildcards
 		for i := 1; i <= from && len(txts) == 0; i++ {
 			zoneSlice := strings.Split(zone, ".")
 			zoneSlice[i] = "_"
 			zone = strings.Join(zoneSlice, ".")
-			txts, err = query(zone, ctx, c)
+			txts, err = lookup(zone, ctx, c)
+			txts = activeRecords(txts, r)
 		}
 	}
-	if err != nil || len(txts) == 0 {
-		return record{}, fmt.Errorf("could not get TXT record: %s", err)
+	if err != nil {
+		return Record{}, fmt.Errorf("could not get TXT record: %s", err)
 	}
-
-	txts[0], err = parsePlaceholders(txts[0], r, pathSlice)
-	rec := record{}
-	if err = rec.Parse(txts[0], r, c); err != nil {
-		return rec, fmt.Errorf("could not parse record: %s", err)
+	if len(txts) == 0 {
+		return Record{}, fmt.Errorf("could not find an active record for %s", zone)
 	}
 
-	if rec.Type == "path" {
-		return rec, fmt.Errorf("chaining path is not currently supported")
+	txt, err := selectRecord(txts)
+	if err != nil {
+		return Record{}, err
+	}
+	requestLogFrom(ctx).setZone(absoluteZone(zone))
+	if txt, err = followRefs(zone, txt, ctx, c, r); err != nil {
+		return Record{}, err
+	}
+	// The answer can be shared with other requests, so it's not modified in place
+	txt, err = parseRecordPlaceholders(txt, r, pathSlice)
+	if err != nil {
+		return Record{}, err
+	}
+	rec := Record{}
+	if err = rec.Parse(txt, r, c); err != nil {
+		return rec, fmt.Errorf("could not parse record: %s", err)
 	}
 
 	return rec, nil
@@ -158,3 +174,110 @@ func sortMap(m map[string]string) []string {
 	}
 	return result
 }
+
+// parseRecordPlaceholders replaces the placeholders in the TXT record.
+// The values of txtv1 records are replaced one by one so the request's
+// data can't change the structure of the record.
+func parseRecordPlaceholders(txt string, r *http.Request, pathSlice []string) (string, error) {
+	if !isTxtv1(txt) {
+		return parsePlaceholders(txt, r, pathSlice)
+	}
+	pairs, err := splitRecord(txt)
+	if err != nil {
+		return "", err
+	}
+	for i := range pairs {
+		if pairs[i].value, err = parsePlaceholders(pairs[i].value, r, pathSlice); err != nil {
+			return "", err
+		}
+	}
+	return joinRecord(pairs), nil
+}
+
+// resolvePath finds the final record for the request's path using the
+// given path record. When the final record is a path record itself, it's
+// resolved recursively against the rest of the path segments under the
+// zone it was found at, up to the configured maximum chaining depth.
+// When the zone of the whole path isn't found, a path record at the zone
+// of a shorter prefix of the path is resolved the same way. The
+// nested path record is returned when the path ends at it, so its root=
+// is served like the root= of the first path record.
+func resolvePath(host, path string, rec Record, ctx context.Context, c Config, r *http.Request) (Record, error) {
+	maxDepth := c.PathChainDepth
+	if maxDepth == 0 {
+		maxDepth = DefaultPathChainDepth
+	}
+	visited := make(map[string]bool)
+	for depth := 1; ; depth++ {
+		zone, from, pathSlice, err := zoneFromPath(host, path, rec, c)
+		if err != nil {
+			return Record{}, err
+		}
+		if visited[zone] {
+			return Record{}, fmt.Errorf("path chaining loop detected at %s", zone)
+		}
+		visited[zone] = true
+
+		final, err := getFinalRecord(zone, from, ctx, c, r, pathSlice)
+		if err != nil && rec.Re == "" && rec.From == "" {
+			// The zone of every path segment isn't found, so a nested
+			// path record can own a prefix of the path
+			if nested, nestedZone, ok := prefixPathRecord(host, path, rec, ctx, c, r); ok && !visited[nestedZone] {
+				final, zone, err = nested, nestedZone, nil
+				visited[zone] = true
+			}
+		}
+		if err == nil {
+			traceFrom(ctx).record(final)
+		}
+		if err != nil || final.Type != "path" {
+			return final, err
+		}
+		if depth >= maxDepth {
+			return Record{}, fmt.Errorf("path chaining exceeded the maximum depth of %d at %s", maxDepth, zone)
+		}
+
+		// The nested record owns the zone, so the zone's labels that
+		// came from the path are consumed
+		consumed := strings.Count(zone, ".") - strings.Count(host, ".") - 1
+		host = strings.TrimPrefix(zone, basezone+".")
+		path = remainingPath(path, consumed)
+		rec = final
+		if path == "/" {
+			if rec.Root == "" {
+				return Record{}, fmt.Errorf("nested path record at %s has no root= for the end of the path", zone)
+			}
+			return rec, nil
+		}
+	}
+}
+
+// prefixPathRecord looks for a path record at the zones of the path's
+// prefixes, from the shortest one. It returns the record and its zone.
+func prefixPathRecord(host, path string, rec Record, ctx context.Context, c Config, r *http.Request) (Record, string, bool) {
+	segments := PathRegex.FindAllString(path, -1)
+	for n := 1; n < len(segments); n++ {
+		zone, _, pathSlice, err := zoneFromPath(host, strings.Join(segments[:n], ""), rec, c)
+		if err != nil {
+			return Record{}, "", false
+		}
+		// The wildcards aren't used, they'd match the longer paths too
+		final, err := getFinalRecord(zone, 0, ctx, c, r, pathSlice)
+		if err == nil && final.Type == "path" {
+			return final, zone, true
+		}
+	}
+	return Record{}, "", false
+}
+
+// remainingPath removes the first n segments of the given path
+func remainingPath(path string, n int) string {
+	segments := PathRegex.FindAllString(path, -1)
+	if n >= len(segments) {
+		return "/"
+	}
+	if n < 0 {
+		n = 0
+	}
+	return strings.Join(segments[n:], "")
+}
@@ -14,7 +14,10 @@ limitations under the License.
 package minitxtd
 
 import (
+	"bytes"
 	"fmt"
+	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -171,12 +174,20 @@ func Test_zoneFromPath(t *testing.T) {
 			"",
 			fmt.Errorf("length of path doesn't match with length of from= in record"),
 		},
+		{
+			"example.com",
+			"/12345-some-path",
+			"",
+			"\\?query=(?P<a>[^&]+)",
+			"",
+			fmt.Errorf("custom regex doesn't work on /12345-some-path"),
+		},
 	}
 	for _, test := range tests {
-		rec := record{}
+		rec := Record{}
 		rec.Re = test.regex
 		rec.From = test.from
-		zone, _, _, err := zoneFromPath(test.host, test.path, rec)
+		zone, _, _, err := zoneFromPath(test.host, test.path, rec, Config{})
 		if err != nil {
 			// Check negative tests
 			if err.Error() == test.err.Error() {
@@ -189,3 +200,87 @@ func Test_zoneFromPath(t *testing.T) {
 		}
 	}
 }
+
+func Test_remainingPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		n        int
+		expected string
+	}{
+		{"/team/docs/intro", 1, "/docs/intro"},
+		{"/team/docs/intro", 2, "/intro"},
+		{"/team/docs/intro", 3, "/"},
+		{"/team", 5, "/"},
+		{"/team/docs", 0, "/team/docs"},
+	}
+	for _, test := range tests {
+		if path := remainingPath(test.path, test.n); path != test.expected {
+			t.Errorf("Expected %s after removing %d segments of %s, got %s", test.expected, test.n, test.path, path)
+		}
+	}
+}
+
+func TestPathChainingE2e(t *testing.T) {
+	source := NewStaticSource(map[string][]string{
+		"chain.test":                     {"v=txtv0;to=https://chain.test;type=path;re=^/([^/]+)"},
+		"_redirect.team.chain.test":      {"v=txtv0;to=https://team.chain.test;root=https://root.team.chain.test;type=path"},
+		"_redirect.docs.team.chain.test": {"v=txtv0;to=https://docs.team.chain.test"},
+		"loop.test":                      {"v=txtv0;to=https://loop.test;type=path;re=^/([^/]+)"},
+		"_redirect.a.loop.test":          {"v=txtv0;to=https://a.loop.test;type=path;re=^/(nothing)"},
+		"deep.test":                      {"v=txtv0;to=https://deep.test;type=path;re=^/([^/]+)"},
+		"_redirect.a.deep.test":          {"v=txtv0;type=path;re=^/([^/]+)"},
+		"_redirect.b.a.deep.test":        {"v=txtv0;type=path;re=^/([^/]+)"},
+		"_redirect.c.b.a.deep.test":      {"v=txtv0;to=https://c.deep.test"},
+		"plain.test":                     {"v=txtv0;to=https://plain.test;type=path"},
+		"_redirect.team.plain.test":      {"v=txtv0;to=https://team.plain.test;root=https://root.team.plain.test;type=path;re=^/([^/]+)"},
+		"_redirect.docs.team.plain.test": {"v=txtv0;to=https://docs.team.plain.test"},
+		"_redirect.home.plain.test":      {"v=txtv0;to=https://home.plain.test"},
+	})
+	tests := []struct {
+		url      string
+		depth    int
+		expected string
+	}{
+		{"https://chain.test/team/docs", 0, "https://docs.team.chain.test"},
+		{"https://chain.test/team", 0, "https://root.team.chain.test"},
+		{"https://chain.test/team/missing", 0, "https://chain.test"},
+		{"https://loop.test/a/b", 0, "https://loop.test"},
+		{"https://deep.test/a/b/c", 0, "https://c.deep.test"},
+		{"https://deep.test/a/b/c", 2, "https://deep.test"},
+		// The parent without re= delegates to the record of a prefix
+		{"https://plain.test/team/docs/intro", 0, "https://docs.team.plain.test"},
+		{"https://plain.test/team", 0, "https://root.team.plain.test"},
+		{"https://plain.test/home/page", 0, "https://plain.test"},
+		{"https://plain.test/other/page", 0, "https://plain.test"},
+	}
+	for _, test := range tests {
+		c := Config{
+			Enable:         []string{"host", "path"},
+			PathChainDepth: test.depth,
+			Source:         source,
+		}
+		req := httptest.NewRequest("GET", test.url, nil)
+		resp := httptest.NewRecorder()
+		if err := c.Serve(resp, req); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if location := resp.Header().Get("Location"); location != test.expected {
+			t.Errorf("Expected %s to redirect to %s, got %s", test.url, test.expected, location)
+		}
+	}
+
+	// The root= of the nested record is served as a path redirect
+	var buf bytes.Buffer
+	c := Config{Enable: []string{"path"}, Source: source, logger: newLogger(&buf, logLevels[LevelInfo])}
+	req := httptest.NewRequest("GET", "https://chain.test/team", nil)
+	resp := httptest.NewRecorder()
+	if err := c.Serve(resp, req); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if location := resp.Header().Get("Location"); location != "https://root.team.chain.test" {
+		t.Errorf("Expected the nested root, got %s", location)
+	}
+	if !strings.Contains(buf.String(), `"type":"path"`) {
+		t.Errorf("Expected a path decision, got %s", buf.String())
+	}
+}
@@ -23,11 +23,12 @@ import (
 	"strings"
 )
 
-var PlaceholderRegex = regexp.MustCompile("{[~>?]?\\w+}")
+var PlaceholderRegex = regexp.MustCompile("{[~>?]?[\\w-]+}")
 
 // parsePlaceholders gets a string input and looks for placeholders inside
 // the string. it will then replace them with the actual data from the request
 func parsePlaceholders(input string, r *http.Request, pathSlice []string) (string, error) {
+	original := input
 	placeholders := PlaceholderRegex.FindAllStringSubmatch(input, -1)
 	for _, placeholder := range placeholders {
 		switch placeholder[0] {
@@ -61,6 +62,8 @@ func parsePlaceholders(input string, r *http.Request, pathSlice []string) (strin
 			input = strings.Replace(input, "{query}", r.URL.RawQuery, -1)
 		case "{query_escaped}":
 			input = strings.Replace(input, "{query_escaped}", url.QueryEscape(r.URL.RawQuery), -1)
+		case "{ua_class}":
+			input = strings.Replace(input, "{ua_class}", userAgentClass(r.UserAgent()), -1)
 		case "{uri_escaped}":
 			input = strings.Replace(input, "{uri_escaped}", url.QueryEscape(r.URL.RequestURI()), -1)
 		case "{user}":
@@ -119,5 +122,6 @@ func parsePlaceholders(input string, r *http.Request, pathSlice []string) (strin
 		input = strings.Replace(input, fmt.Sprintf("{$%d}", k+1), v, -1)
 	}
 
+	traceFrom(r.Context()).placeholder(original, input)
 	return input, nil
 }
@@ -20,7 +20,6 @@ import (
 	"sync"
 	"time"
 
-	"github.com/mholt/caddy/caddyhttp/httpserver"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -31,8 +30,6 @@ type Prometheus struct {
 	Address string
 	Path    string
 
-	once    sync.Once
-	next    httpserver.Handler
 	handler http.Handler
 }
 
@@ -67,6 +64,18 @@ var (
 		Help:      "Total redirects per path for each host",
 	}, []string{"host", "path"})
 
+	ResolverHealth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "txtdirect",
+		Name:      "resolver_healthy",
+		Help:      "Health of each upstream resolver (1 for healthy and 0 for ejected)",
+	}, []string{"resolver"})
+
+	ResolverFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "txtdirect",
+		Name:      "resolver_failures_total",
+		Help:      "Total failed queries for each upstream resolver",
+	}, []string{"resolver"})
+
 	once sync.Once
 )
 
@@ -89,15 +98,18 @@ func (p *Prometheus) SetDefaults() {
 }
 
 func (p *Prometheus) start() error {
-	p.once.Do(func() {
+	once.Do(func() {
 		prometheus.MustRegister(RequestsCount)
 		prometheus.MustRegister(RequestsByStatus)
 		prometheus.MustRegister(RequestsCountBasedOnType)
 		prometheus.MustRegister(FallbacksCount)
 		prometheus.MustRegister(PathRedirectCount)
-		http.Handle(p.Path, p.handler)
+		prometheus.MustRegister(ResolverHealth)
+		prometheus.MustRegister(ResolverFailures)
+		mux := http.NewServeMux()
+		mux.Handle(p.Path, p.handler)
 		go func() {
-			err := http.ListenAndServe(p.Address, nil)
+			err := http.ListenAndServe(p.Address, mux)
 			if err != nil {
 				log.Printf("[txtdirect]: Couldn't start http handler for prometheus metrics. %s", err.Error())
 			}
@@ -106,25 +118,13 @@ func (p *Prometheus) start() error {
 	return nil
 }
 
-func (p *Prometheus) Setup() {
+// Setup registers the metrics and starts serving them on
+// the configured address
+func (p *Prometheus) Setup() error {
+	p.SetDefaults()
 	p.handler = promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{
 		ErrorHandling: promhttp.HTTPErrorOnError,
 		ErrorLog:      log.New(os.Stderr, "", log.LstdFlags),
 	})
-
-	cfg := httpserver.GetConfig(c)
-	cfg.AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
-		p.next = next
-		return p
-	})
-}
-
-func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
-	next := p.next
-
-	rw := httpserver.NewResponseRecorder(w)
-
-	status, err := next.ServeHTTP(rw, r)
-
-	return status, err
+	return p.start()
 }
@@ -18,13 +18,28 @@ import (
 	"compress/gzip"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
 	"sync"
-
-	"github.com/mholt/caddy/caddyhttp/proxy"
+	"time"
 )
 
+// proxyTransport is shared by the proxied requests to reuse the
+// connections to the upstreams
+var proxyTransport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:       proxyTimeout,
+		KeepAlive:     30 * time.Second,
+		FallbackDelay: fallbackDelay,
+	}).DialContext,
+	MaxIdleConnsPerHost:   proxyKeepalive,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+}
+
 type ProxyResponse struct {
 	headers    http.Header
 	body       []byte
@@ -33,7 +48,7 @@ type ProxyResponse struct {
 	status     int
 }
 
-func proxyRequest(w http.ResponseWriter, r *http.Request, rec record, c Config, fallbackURL string, code int) error {
+func proxyRequest(w http.ResponseWriter, r *http.Request, rec Record, c Config, fallbackURL string, code int) error {
 	to, _, err := getBaseTarget(rec, r)
 	if err != nil {
 		return err
@@ -42,10 +57,28 @@ func proxyRequest(w http.ResponseWriter, r *http.Request, rec record, c Config,
 	if err != nil {
 		return err
 	}
-	reverseProxy := proxy.NewSingleHostReverseProxy(u, "", proxyKeepalive, proxyTimeout, fallbackDelay)
+	var proxyErr error
+	reverseProxy := httputil.NewSingleHostReverseProxy(u)
+	reverseProxy.Transport = proxyTransport
+	reverseProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		proxyErr = err
+	}
+
+	// The upstream gets the request ID to correlate its logs with ours
+	id := requestIDFrom(r.Context())
+	if id != "" && r.Header.Get(RequestIDHeader) != id {
+		header := make(http.Header, len(r.Header)+1)
+		copyHeader(header, r.Header)
+		header.Set(RequestIDHeader, id)
+		r = r.WithContext(r.Context())
+		r.Header = header
+	}
 
 	tmpResponse := ProxyResponse{headers: make(http.Header)}
-	reverseProxy.ServeHTTP(&tmpResponse, r, nil)
+	reverseProxy.ServeHTTP(&tmpResponse, r)
+	if proxyErr != nil {
+		return fmt.Errorf("[txtdirect]: Couldn't proxy the request to %s: %s", u.Host, proxyErr)
+	}
 
 	// Decompress the body based on "Content-Encoding" header and write to a writer buffer
 	if err := tmpResponse.WriteBody(); err != nil {
@@ -58,6 +91,9 @@ func proxyRequest(w http.ResponseWriter, r *http.Request, rec record, c Config,
 	}
 
 	copyHeader(w.Header(), tmpResponse.Header())
+	if id != "" {
+		w.Header().Set(RequestIDHeader, id)
+	}
 
 	// Write the status from the temporary ResponseWriter to the main ResponseWriter
 	w.WriteHeader(tmpResponse.status)
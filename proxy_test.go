@@ -0,0 +1,65 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProxyRequestE2e(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("proxied " + r.URL.Path))
+	}))
+	defer upstream.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	c := Config{
+		Enable: []string{"proxy"},
+		Source: NewStaticSource(map[string][]string{
+			"proxy.test": {"v=txtv1;type=proxy;to=" + upstream.URL},
+			"down.test":  {"v=txtv1;type=proxy;to=" + down.URL},
+		}),
+	}
+	tests := []struct {
+		url      string
+		status   int
+		body     string
+		location string
+	}{
+		{"https://proxy.test/docs", http.StatusAccepted, "proxied /docs", ""},
+		// The unreachable upstreams fall back to a redirect
+		{"https://down.test/docs", http.StatusFound, "", down.URL},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		resp := httptest.NewRecorder()
+		if err := c.Serve(resp, req); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if resp.Code != test.status {
+			t.Errorf("Expected status %d for %s, got %d", test.status, test.url, resp.Code)
+		}
+		if test.body != "" && resp.Body.String() != test.body {
+			t.Errorf("Expected body %q for %s, got %q", test.body, test.url, resp.Body.String())
+		}
+		if resp.Header().Get("Location") != test.location {
+			t.Errorf("Expected location %q for %s, got %q", test.location, test.url, resp.Header().Get("Location"))
+		}
+	}
+}
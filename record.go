@@ -16,51 +16,84 @@ package minitxtd
 import (
 	"context"
 	"fmt"
-	"log"
+	"math"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
-type record struct {
-	Version string
-	To      string
-	Code    int
-	Type    string
-	Vcs     string
-	Website string
-	From    string
-	Root    string
-	Re      string
+// Record is a parsed TXTDirect TXT record
+type Record struct {
+	Version  string
+	To       string
+	Code     int
+	Type     string
+	Vcs      string
+	Website  string
+	From     string
+	Root     string
+	Re       string
+	Priority int
+	// Targets are all the to= addresses of the record as they're written,
+	// To is the first one with its placeholders replaced. Weights and
+	// Sticky control which target is used.
+	Targets []string
+	Weights []int
+	Sticky  string
+	// FromTime and UntilTime limit the time window in which
+	// the record is served
+	FromTime  time.Time
+	UntilTime time.Time
+	// When holds the conditions the request must match
+	When string
 }
 
+// clock returns the current time, it's replaced in tests
+var clock = time.Now
+
+// errDockerv2Target is returned for dockerv2 records without a to= key
+var errDockerv2Target = fmt.Errorf("[txtdirect]: to= field is required in dockerv2 type")
+
 // getRecord uses the given host to find a TXT record
 // and then parses the txt record and returns a TXTDirect record
 // struct instance. It returns an error when it can't find any txt
 // records or if the TXT record is not standard.
-func getRecord(host string, ctx context.Context, c Config, r *http.Request) (record, error) {
-	txts, err := query(host, ctx, c)
+func getRecord(host string, ctx context.Context, c Config, r *http.Request) (Record, error) {
+	txts, err := lookup(host, ctx, c)
 	if err != nil {
-		log.Printf("Initial DNS query failed: %s", err)
+		c.logger.Debugf("Initial DNS query failed: %s", err)
 	}
+	// Records out of their time window or with conditions that don't
+	// match the request are treated as absent
+	txts = activeRecords(txts, r)
 	// if error present or record empty, jump into wildcards
-	if err != nil || txts[0] == "" {
+	if err != nil || len(txts) == 0 || txts[0] == "" {
 		hostSlice := strings.Split(host, ".")
 		hostSlice[0] = "_"
 		host = strings.Join(hostSlice, ".")
-		txts, err = query(host, ctx, c)
+		txts, err = lookup(host, ctx, c)
 		if err != nil {
-			log.Printf("Wildcard DNS query failed: %s", err.Error())
-			return record{}, err
+			c.logger.Debugf("Wildcard DNS query failed: %s", err.Error())
+			return Record{}, err
+		}
+		if txts = activeRecords(txts, r); len(txts) == 0 {
+			return Record{}, fmt.Errorf("could not find an active record for %s", host)
 		}
 	}
 
-	if len(txts) != 1 {
-		return record{}, fmt.Errorf("could not parse TXT record with %d records", len(txts))
+	txt, err := selectRecord(txts)
+	if err != nil {
+		return Record{}, err
+	}
+	requestLogFrom(ctx).setZone(absoluteZone(host))
+	if txt, err = followRefs(host, txt, ctx, c, r); err != nil {
+		return Record{}, err
 	}
 
-	rec := record{}
-	if err = rec.Parse(txts[0], r, c); err != nil {
+	rec := Record{}
+	if err = rec.Parse(txt, r, c); err != nil {
 		return rec, fmt.Errorf("could not parse record: %s", err)
 	}
 
@@ -71,74 +104,152 @@ func getRecord(host string, ctx context.Context, c Config, r *http.Request) (rec
 // a TXTDirect record struct instance.
 // It will return an error if the DNS TXT record is not standard or
 // if the record type is not enabled in the TXTDirect's config.
-func (r *record) Parse(str string, req *http.Request, c Config) error {
-	s := strings.Split(str, ";")
-	for _, l := range s {
-		switch {
-		case strings.HasPrefix(l, "code="):
-			l = strings.TrimPrefix(l, "code=")
+func (r *Record) Parse(str string, req *http.Request, c Config) error {
+	if err := r.parse(str, req, c.logger); err != nil {
+		return err
+	}
+
+	if !contains(c.Enable, r.Type) {
+		return fmt.Errorf("%s type is not enabled in configuration", r.Type)
+	}
+
+	return nil
+}
+
+// ParseRecord parses the given TXT record on its own. The placeholders
+// are kept as-is since there's no request and the record's type isn't
+// checked against any configuration.
+func ParseRecord(txt string) (Record, error) {
+	rec := Record{}
+	err := rec.parse(txt, nil, nil)
+	return rec, err
+}
+
+// parse parses the TXT record and replaces the placeholders in the
+// to= and from= keys with the request's data if there's a request.
+// Warnings about the record go to the given logger.
+func (r *Record) parse(str string, req *http.Request, logger *Logger) error {
+	pairs, err := splitRecord(str)
+	if err != nil {
+		return err
+	}
+	for _, p := range pairs {
+		l := p.value
+		switch p.key {
+		case "code":
 			i, err := strconv.Atoi(l)
 			if err != nil {
 				return fmt.Errorf("could not parse status code: %s", err)
 			}
 			r.Code = i
 
-		case strings.HasPrefix(l, "from="):
-			l = strings.TrimPrefix(l, "from=")
-			l, err := parsePlaceholders(l, req, []string{})
-			if err != nil {
-				return err
+		case "from":
+			if req != nil {
+				if l, err = parsePlaceholders(l, req, []string{}); err != nil {
+					return err
+				}
 			}
 			r.From = l
 
-		case strings.HasPrefix(l, "re="):
-			l = strings.TrimPrefix(l, "re=")
+		case "from-time":
+			t, err := parseRecordTime(l)
+			if err != nil {
+				return fmt.Errorf("could not parse from-time: %s", err)
+			}
+			r.FromTime = t
+
+		case "priority":
+			i, err := strconv.Atoi(l)
+			if err != nil {
+				return fmt.Errorf("could not parse priority: %s", err)
+			}
+			r.Priority = i
+
+		case "re":
 			r.Re = l
 
-		case strings.HasPrefix(l, "root="):
-			l = strings.TrimPrefix(l, "root=")
+		case "root":
 			r.Root = l
 
-		case strings.HasPrefix(l, "to="):
-			l = strings.TrimPrefix(l, "to=")
-			l, err := parsePlaceholders(l, req, []string{})
-			if err != nil {
-				return err
+		case "to":
+			// The targets keep their placeholders, they're replaced
+			// once one of them is selected
+			r.Targets = append(r.Targets, l)
+			if req != nil {
+				if l, err = parsePlaceholders(l, req, []string{}); err != nil {
+					return err
+				}
+			}
+			if r.To == "" {
+				r.To = l
+			}
+
+		case "sticky":
+			if l != "cookie" && l != "ip" {
+				return fmt.Errorf("unknown sticky method '%s'", l)
 			}
-			r.To = l
+			r.Sticky = l
 
-		case strings.HasPrefix(l, "type="):
-			l = strings.TrimPrefix(l, "type=")
+		case "type":
 			r.Type = l
 
-		case strings.HasPrefix(l, "v="):
-			l = strings.TrimPrefix(l, "v=")
+		case "until-time":
+			t, err := parseRecordTime(l)
+			if err != nil {
+				return fmt.Errorf("could not parse until-time: %s", err)
+			}
+			r.UntilTime = t
+
+		case "v":
 			r.Version = l
-			if r.Version != "txtv0" {
+			switch {
+			case r.Version == "txtv1" && !isTxtv1(str):
+				return fmt.Errorf("txtv1 records must start with %s", txtv1Prefix)
+			case r.Version == "txtv0":
+				logger.Warnf("txtv0 is not suitable for production")
+			case r.Version != "txtv1":
 				return fmt.Errorf("unhandled version '%s'", r.Version)
 			}
-			log.Print("WARN: txtv0 is not suitable for production")
 
-		case strings.HasPrefix(l, "vcs="):
-			l = strings.TrimPrefix(l, "vcs=")
+		case "vcs":
 			r.Vcs = l
 
-		case strings.HasPrefix(l, "website="):
-			l = strings.TrimPrefix(l, "website=")
+		case "when":
+			if _, err := parseConditions(l); err != nil {
+				return err
+			}
+			r.When = l
+
+		case "website":
 			r.Website = l
 
+		case "weight":
+			for _, w := range strings.Split(l, ",") {
+				i, err := strconv.Atoi(w)
+				if err != nil || i < 0 {
+					return fmt.Errorf("could not parse weight '%s'", w)
+				}
+				r.Weights = append(r.Weights, i)
+			}
+
 		default:
-			tuple := strings.Split(l, "=")
-			if len(tuple) != 2 {
+			// Unknown keys are allowed, txtv1 pairs are already validated
+			if !isTxtv1(str) && strings.Count(p.raw, "=") != 1 {
 				return fmt.Errorf("arbitrary data not allowed")
 			}
-			continue
 		}
-		if len(l) > 255 {
-			return fmt.Errorf("TXT record cannot exceed the maximum of 255 characters")
+	}
+
+	if r.Type == "dockerv2" && r.To == "" {
+		return errDockerv2Target
+	}
+
+	if len(r.Weights) != 0 {
+		if len(r.Weights) != len(r.Targets) {
+			return fmt.Errorf("got %d weights for %d targets", len(r.Weights), len(r.Targets))
 		}
-		if r.Type == "dockerv2" && r.To == "" {
-			return fmt.Errorf("[txtdirect]: to= field is required in dockerv2 type")
+		if totalWeight(r.Weights) == 0 {
+			return fmt.Errorf("at least one of the targets must have a weight")
 		}
 	}
 
@@ -150,9 +261,116 @@ func (r *record) Parse(str string, req *http.Request, c Config) error {
 		r.Type = "host"
 	}
 
-	if !contains(c.Enable, r.Type) {
-		return fmt.Errorf("%s type is not enabled in configuration", r.Type)
+	return nil
+}
+
+// selectRecord picks the TXT record to use among the records of a zone.
+// A single record is used as-is. When there are several records, the
+// ones without a TXTDirect v= key (e.g. SPF or verification tokens)
+// are ignored and the record with the lowest priority= wins. Records
+// without a priority come after the prioritized ones, then the highest
+// version wins and the remaining ties are broken by the record's text
+// so the answer order of the DNS doesn't matter.
+func selectRecord(txts []string) (string, error) {
+	if len(txts) == 1 {
+		return txts[0], nil
 	}
 
-	return nil
+	var candidates []string
+	for _, txt := range txts {
+		if recordVersion(txt) >= 0 {
+			candidates = append(candidates, txt)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("could not find a TXTDirect record among %d records", len(txts))
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		pi, pj := recordPriority(candidates[i]), recordPriority(candidates[j])
+		if pi != pj {
+			return pi < pj
+		}
+		vi, vj := recordVersion(candidates[i]), recordVersion(candidates[j])
+		if vi != vj {
+			return vi > vj
+		}
+		return candidates[i] < candidates[j]
+	})
+	return candidates[0], nil
+}
+
+// recordValue returns the value of the given key in the TXT record
+func recordValue(txt, key string) (string, bool) {
+	pairs, err := splitRecord(txt)
+	if err != nil {
+		return "", false
+	}
+	for _, p := range pairs {
+		if p.key == key {
+			return p.value, true
+		}
+	}
+	return "", false
+}
+
+// recordPriority returns the priority of the TXT record. Records
+// without a valid priority sort after every prioritized record.
+func recordPriority(txt string) int {
+	if v, ok := recordValue(txt, "priority"); ok {
+		if i, err := strconv.Atoi(v); err == nil {
+			return i
+		}
+	}
+	return math.MaxInt32
+}
+
+// recordVersion returns the number of the TXT record's version,
+// e.g. 0 for txtv0, or -1 when the version is unknown
+func recordVersion(txt string) int {
+	v, _ := recordValue(txt, "v")
+	if !strings.HasPrefix(v, "txtv") {
+		return -1
+	}
+	i, err := strconv.Atoi(strings.TrimPrefix(v, "txtv"))
+	if err != nil {
+		return -1
+	}
+	return i
+}
+
+// activeRecords drops the TXT records that are out of their time window
+// or have when= conditions that the request doesn't match. Records with
+// invalid values are kept so parsing reports them.
+func activeRecords(txts []string, r *http.Request) []string {
+	now := clock()
+	var active []string
+	for _, txt := range txts {
+		if v, ok := recordValue(txt, "when"); ok {
+			if match, err := matchConditions(v, r); err == nil && !match {
+				continue
+			}
+		}
+		if v, ok := recordValue(txt, "from-time"); ok {
+			if t, err := parseRecordTime(v); err == nil && now.Before(t) {
+				continue
+			}
+		}
+		if v, ok := recordValue(txt, "until-time"); ok {
+			if t, err := parseRecordTime(v); err == nil && !now.Before(t) {
+				continue
+			}
+		}
+		active = append(active, txt)
+	}
+	return active
+}
+
+// parseRecordTime parses the RFC 3339 or Unix timestamp time values
+func parseRecordTime(value string) (time.Time, error) {
+	if sec, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(sec, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t.UTC(), err
 }
@@ -16,19 +16,22 @@ package minitxtd
 import (
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestParse(t *testing.T) {
 	tests := []struct {
 		txtRecord string
-		expected  record
+		expected  Record
 		err       error
 	}{
 		{
 			"v=txtv0;to=https://example.com/;code=302",
-			record{
+			Record{
 				Version: "txtv0",
 				To:      "https://example.com/",
 				Code:    302,
@@ -38,7 +41,7 @@ func TestParse(t *testing.T) {
 		},
 		{
 			"v=txtv0;to=https://example.com/",
-			record{
+			Record{
 				Version: "txtv0",
 				To:      "https://example.com/",
 				Code:    302,
@@ -48,7 +51,7 @@ func TestParse(t *testing.T) {
 		},
 		{
 			"v=txtv0;to=https://example.com/;code=302",
-			record{
+			Record{
 				Version: "txtv0",
 				To:      "https://example.com/",
 				Code:    302,
@@ -58,7 +61,7 @@ func TestParse(t *testing.T) {
 		},
 		{
 			"v=txtv0;to=https://example.com/;code=302;vcs=hg;type=gometa",
-			record{
+			Record{
 				Version: "txtv0",
 				To:      "https://example.com/",
 				Code:    302,
@@ -69,7 +72,7 @@ func TestParse(t *testing.T) {
 		},
 		{
 			"v=txtv0;to=https://example.com/;code=302;type=gometa;vcs=git",
-			record{
+			Record{
 				Version: "txtv0",
 				To:      "https://example.com/",
 				Code:    302,
@@ -80,22 +83,22 @@ func TestParse(t *testing.T) {
 		},
 		{
 			"v=txtv0;to=https://example.com/;code=test",
-			record{},
+			Record{},
 			fmt.Errorf("could not parse status code"),
 		},
 		{
-			"v=txtv1;to=https://example.com/;code=test",
-			record{},
-			fmt.Errorf("unhandled version 'txtv1'"),
+			"v=txtv2;to=https://example.com/;code=test",
+			Record{},
+			fmt.Errorf("unhandled version 'txtv2'"),
 		},
 		{
 			"v=txtv0;https://example.com/",
-			record{},
+			Record{},
 			fmt.Errorf("arbitrary data not allowed"),
 		},
 		{
 			"v=txtv0;to=https://example.com/caddy;type=path;code=302",
-			record{
+			Record{
 				Version: "txtv0",
 				To:      "https://example.com/caddy",
 				Type:    "path",
@@ -105,7 +108,7 @@ func TestParse(t *testing.T) {
 		},
 		{
 			"v=txtv0;to=https://example.com/;key=value",
-			record{
+			Record{
 				Version: "txtv0",
 				To:      "https://example.com/",
 				Code:    302,
@@ -113,9 +116,19 @@ func TestParse(t *testing.T) {
 			},
 			nil,
 		},
+		{
+			"v=txtv0;to=https://example.com/" + longPath,
+			Record{
+				Version: "txtv0",
+				To:      "https://example.com/" + longPath,
+				Code:    302,
+				Type:    "host",
+			},
+			nil,
+		},
 		{
 			"v=txtv0;to={?url}",
-			record{
+			Record{
 				Version: "txtv0",
 				To:      "https://example.com/testing",
 				Code:    302,
@@ -125,7 +138,7 @@ func TestParse(t *testing.T) {
 		},
 		{
 			"v=txtv0;to={?url};from={method}",
-			record{
+			Record{
 				Version: "txtv0",
 				To:      "https://example.com/testing",
 				Code:    302,
@@ -137,7 +150,7 @@ func TestParse(t *testing.T) {
 	}
 
 	for i, test := range tests {
-		r := record{}
+		r := Record{}
 		c := Config{
 			Enable: []string{test.expected.Type},
 		}
@@ -172,3 +185,168 @@ func TestParse(t *testing.T) {
 		}
 	}
 }
+
+func Test_selectRecord(t *testing.T) {
+	tests := []struct {
+		txts     []string
+		expected string
+		err      bool
+	}{
+		{
+			[]string{"to=https://example.com"},
+			"to=https://example.com",
+			false,
+		},
+		{
+			[]string{"v=spf1 -all", "v=txtv0;to=https://example.com", "token=1234"},
+			"v=txtv0;to=https://example.com",
+			false,
+		},
+		{
+			[]string{"v=spf1 -all", "token=1234"},
+			"",
+			true,
+		},
+		{
+			[]string{"v=txtv0;to=https://b.example.com", "v=txtv0;to=https://a.example.com"},
+			"v=txtv0;to=https://a.example.com",
+			false,
+		},
+		{
+			[]string{"v=txtv0;to=https://a.example.com", "v=txtv0;to=https://b.example.com;priority=5"},
+			"v=txtv0;to=https://b.example.com;priority=5",
+			false,
+		},
+		{
+			[]string{"v=txtv0;to=https://a.example.com;priority=10", "v=txtv0;to=https://b.example.com;priority=5"},
+			"v=txtv0;to=https://b.example.com;priority=5",
+			false,
+		},
+		{
+			[]string{"v=txtv0;to=https://a.example.com", "v=txtv1;to=https://b.example.com"},
+			"v=txtv1;to=https://b.example.com",
+			false,
+		},
+	}
+	for i, test := range tests {
+		// The answer order of the DNS shouldn't change the selected record
+		swapped := append([]string{}, test.txts...)
+		reverse(swapped)
+		for _, txts := range [][]string{test.txts, swapped} {
+			txt, err := selectRecord(txts)
+			if test.err {
+				if err == nil {
+					t.Errorf("Test %d: Expected an error, got %s", i, txt)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("Test %d: Unexpected error: %s", i, err)
+				continue
+			}
+			if txt != test.expected {
+				t.Errorf("Test %d: Expected %s, got %s", i, test.expected, txt)
+			}
+		}
+	}
+}
+
+func TestMultipleRecordsE2e(t *testing.T) {
+	c := Config{
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+		Enable:   []string{"host"},
+	}
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"https://multiple.test", "https://first.multiple.test"},
+		{"https://spf.test", "https://spf.test"},
+		{"https://priority.test", "https://high.priority.test"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		resp := httptest.NewRecorder()
+		if err := c.Serve(resp, req); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if location := resp.Header().Get("Location"); location != test.expected {
+			t.Errorf("Expected %s to redirect to %s, got %s", test.url, test.expected, location)
+		}
+	}
+}
+
+func Test_activeRecords(t *testing.T) {
+	defaultClock := clock
+	defer func() { clock = defaultClock }()
+	clock = func() time.Time { return time.Date(2019, 6, 15, 12, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		txt    string
+		active bool
+	}{
+		{"v=txtv0;to=https://example.test", true},
+		{"v=txtv0;to=https://example.test;from-time=2019-06-01T00:00:00Z", true},
+		{"v=txtv0;to=https://example.test;from-time=2019-07-01T00:00:00Z", false},
+		{"v=txtv0;to=https://example.test;until-time=2019-07-01T00:00:00Z", true},
+		{"v=txtv0;to=https://example.test;until-time=2019-06-15T12:00:00Z", false},
+		{"v=txtv0;to=https://example.test;from-time=1559347200;until-time=1561939200", true},
+		{"v=txtv0;to=https://example.test;from-time=1561939200", false},
+		{"v=txtv0;to=https://example.test;from-time=2019-06-16T00:00:00+02:00", false},
+		// Invalid values are left for the parser to report
+		{"v=txtv0;to=https://example.test;from-time=tomorrow", true},
+	}
+	for _, test := range tests {
+		active := len(activeRecords([]string{test.txt}, httptest.NewRequest("GET", "https://example.test", nil))) == 1
+		if active != test.active {
+			t.Errorf("Expected %s to be active: %t, got %t", test.txt, test.active, active)
+		}
+	}
+
+	rec := Record{}
+	req := httptest.NewRequest("GET", "https://example.test", nil)
+	if err := rec.Parse("v=txtv0;to=https://example.test;from-time=tomorrow", req, Config{Enable: []string{"host"}}); err == nil {
+		t.Errorf("Expected an error for an invalid from-time")
+	}
+}
+
+func TestTimeWindowE2e(t *testing.T) {
+	defaultClock := clock
+	defer func() { clock = defaultClock }()
+	clock = func() time.Time { return time.Date(2019, 6, 15, 12, 0, 0, 0, time.UTC) }
+
+	c := Config{
+		Enable:   []string{"host", "path"},
+		Redirect: "https://fallback.window.test",
+		Source: NewStaticSource(map[string][]string{
+			"expired.window.test": {"v=txtv0;to=https://expired.window.test;until-time=2019-06-01T00:00:00Z"},
+			"_.window.test":       {"v=txtv0;to=https://wildcard.window.test"},
+			"upcoming.test":       {"v=txtv0;to=https://upcoming.test;from-time=2019-07-01T00:00:00Z"},
+			"campaign.test": {
+				"v=txtv0;to=https://sale.campaign.test;priority=1;from-time=2019-06-01T00:00:00Z;until-time=2019-07-01T00:00:00Z",
+				"v=txtv0;to=https://campaign.test;priority=2",
+			},
+			"path.window.test":                {"v=txtv0;to=https://path.window.test;type=path"},
+			"_redirect.sale.path.window.test": {"v=txtv0;to=https://sale.path.window.test;until-time=2019-06-01T00:00:00Z"},
+		}),
+	}
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"https://expired.window.test", "https://wildcard.window.test"},
+		{"https://upcoming.test", c.Redirect},
+		{"https://campaign.test", "https://sale.campaign.test"},
+		{"https://path.window.test/sale", "https://path.window.test"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		resp := httptest.NewRecorder()
+		if err := c.Serve(resp, req); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if location := resp.Header().Get("Location"); location != test.expected {
+			t.Errorf("Expected %s to redirect to %s, got %s", test.url, test.expected, location)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DefaultRefMaxHops is the default maximum number of ref= references
+// that are followed for a record
+const DefaultRefMaxHops = 5
+
+// followRefs follows the ref= key of the given TXT record to the
+// referenced zones. The keys of the referencing record override the
+// keys of the referenced record.
+func followRefs(zone, txt string, ctx context.Context, c Config, r *http.Request) (string, error) {
+	maxHops := c.RefMaxHops
+	if maxHops == 0 {
+		maxHops = DefaultRefMaxHops
+	}
+
+	chain := []string{strings.ToLower(absoluteZone(zone))}
+	for {
+		ref, ok := recordValue(txt, "ref")
+		if !ok {
+			break
+		}
+		if len(chain) > maxHops {
+			return "", fmt.Errorf("exceeded the maximum of %d references: %s", maxHops, strings.Join(chain, " > "))
+		}
+		ref = strings.ToLower(absoluteZone(ref))
+		if contains(chain, ref) {
+			return "", fmt.Errorf("reference loop detected: %s > %s", strings.Join(chain, " > "), ref)
+		}
+		chain = append(chain, ref)
+
+		txts, err := lookup(ref, ctx, c)
+		if err != nil {
+			return "", fmt.Errorf("could not follow the reference to %s: %s", ref, err)
+		}
+		if txts = activeRecords(txts, r); len(txts) == 0 {
+			return "", fmt.Errorf("could not find an active record for the reference to %s", ref)
+		}
+		referenced, err := selectRecord(txts)
+		if err != nil {
+			return "", err
+		}
+		txt = mergeRecords(referenced, txt)
+	}
+
+	if len(chain) > 1 {
+		c.logger.Debugf("%s is resolved through %s", chain[0], strings.Join(chain, " > "))
+	}
+	return txt, nil
+}
+
+// mergeRecords overrides the keys of the base TXT record with the keys
+// of the given record, except for its ref= key. Repeatable keys such as
+// to= are overridden as a whole. The merged record is upgraded to txtv1
+// when a txtv0 record gets the values of a txtv1 record that need quoting.
+func mergeRecords(base, override string) string {
+	basePairs, _ := splitRecord(base)
+	overridePairs, _ := splitRecord(override)
+
+	var keys []string
+	values := make(map[string][]recordPair)
+	for _, p := range basePairs {
+		if _, ok := values[p.key]; !ok {
+			keys = append(keys, p.key)
+		}
+		values[p.key] = append(values[p.key], p)
+	}
+	replaced := make(map[string]bool)
+	for _, p := range overridePairs {
+		if p.key == "ref" || p.raw == "" && p.key == "" {
+			continue
+		}
+		if _, ok := values[p.key]; !ok {
+			keys = append(keys, p.key)
+		} else if !replaced[p.key] {
+			values[p.key] = nil
+		}
+		replaced[p.key] = true
+		values[p.key] = append(values[p.key], p)
+	}
+
+	var merged []recordPair
+	for _, key := range keys {
+		merged = append(merged, values[key]...)
+	}
+	return joinRecord(upgradeVersion(merged))
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_mergeRecords(t *testing.T) {
+	tests := []struct {
+		base     string
+		override string
+		expected string
+	}{
+		{
+			"v=txtv0;to=https://shared.test;code=302",
+			"ref=_redirect.shared.test",
+			"v=txtv0;to=https://shared.test;code=302",
+		},
+		{
+			"v=txtv0;to=https://shared.test;code=302",
+			"v=txtv0;ref=_redirect.shared.test;code=301;website=https://docs.test",
+			"v=txtv0;to=https://shared.test;code=301;website=https://docs.test",
+		},
+		{
+			"v=txtv0;to=https://a.test;to=https://b.test;weight=50,50",
+			"to=https://c.test;ref=shared.test",
+			"v=txtv0;to=https://c.test;weight=50,50",
+		},
+		{
+			"v=txtv0;ref=_redirect.next.test;code=302",
+			"ref=_redirect.shared.test;code=301",
+			"v=txtv0;ref=_redirect.next.test;code=301",
+		},
+		{
+			`v=txtv1;to="https://x.test/?a=1;b=2";code=302`,
+			"v=txtv0;ref=_redirect.shared.test;code=301",
+			`v=txtv1;to="https://x.test/?a=1;b=2";code=301`,
+		},
+		{
+			"to=https://shared.test;v=txtv0",
+			"v=txtv1;ref=_redirect.shared.test",
+			"v=txtv1;to=https://shared.test",
+		},
+	}
+	for _, test := range tests {
+		if merged := mergeRecords(test.base, test.override); merged != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, merged)
+		}
+	}
+}
+
+func TestRefE2e(t *testing.T) {
+	source := NewStaticSource(map[string][]string{
+		"shared.test":              {"v=txtv0;to=https://landing.shared.test;code=302"},
+		"vanity.test":              {"v=txtv0;ref=_redirect.shared.test"},
+		"override.test":            {"v=txtv0;ref=shared.test;to=https://override.test"},
+		"hop1.test":                {"v=txtv0;ref=hop2.test"},
+		"hop2.test":                {"v=txtv0;ref=hop3.test"},
+		"hop3.test":                {"v=txtv0;ref=shared.test"},
+		"loop1.test":               {"v=txtv0;ref=loop2.test"},
+		"loop2.test":               {"v=txtv0;ref=loop1.test"},
+		"dangling.test":            {"v=txtv0;ref=missing.test"},
+		"path.test":                {"v=txtv0;to=https://path.test;type=path"},
+		"_redirect.docs.path.test": {"v=txtv0;ref=shared.test"},
+		"quoted.test":              {`v=txtv1;to="https://quoted.test/?a=1;b=2"`},
+		"v0.test":                  {"v=txtv0;ref=quoted.test"},
+	})
+	tests := []struct {
+		url      string
+		maxHops  int
+		expected string
+	}{
+		{"https://vanity.test", 0, "https://landing.shared.test"},
+		{"https://override.test", 0, "https://override.test"},
+		{"https://hop1.test", 0, "https://landing.shared.test"},
+		{"https://hop1.test", 2, "https://fallback.test"},
+		{"https://loop1.test", 0, "https://fallback.test"},
+		{"https://dangling.test", 0, "https://fallback.test"},
+		{"https://path.test/docs", 0, "https://landing.shared.test"},
+		{"https://v0.test", 0, "https://quoted.test/?a=1;b=2"},
+	}
+	for _, test := range tests {
+		c := Config{
+			Enable:     []string{"host", "path"},
+			Redirect:   "https://fallback.test",
+			RefMaxHops: test.maxHops,
+			Source:     source,
+		}
+		req := httptest.NewRequest("GET", test.url, nil)
+		resp := httptest.NewRecorder()
+		if err := c.Serve(resp, req); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if location := resp.Header().Get("Location"); location != test.expected {
+			t.Errorf("Expected %s to redirect to %s, got %s", test.url, test.expected, location)
+		}
+	}
+
+	c := Config{Source: source}
+	if _, err := followRefs("loop1.test", "v=txtv0;ref=loop2.test", context.Background(), c, httptest.NewRequest("GET", "https://loop1.test", nil)); err == nil {
+		t.Errorf("Expected an error for a reference loop")
+	}
+}
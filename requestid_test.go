@@ -0,0 +1,143 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func Test_validRequestID(t *testing.T) {
+	tests := []struct {
+		id       string
+		expected bool
+	}{
+		{"4f2c1a9e-0b7d-4c55-9a1e-3f8d2b6c7e10", true},
+		{"edge-1:42", true},
+		{"", false},
+		{"a b", false},
+		{"a\tb", false},
+		{"caf\xc3\xa9", false},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+	for _, test := range tests {
+		if valid := validRequestID(test.id); valid != test.expected {
+			t.Errorf("Expected %t for %q, got %t", test.expected, test.id, valid)
+		}
+	}
+}
+
+func TestRequestIDE2e(t *testing.T) {
+	var buf bytes.Buffer
+	c := Config{
+		Enable:   []string{"host", "dockerv2"},
+		Redirect: "https://fallback.test",
+		Source: NewStaticSource(map[string][]string{
+			"example.test": {"v=txtv1;to=https://target.test"},
+			"v0.test":      {"v=txtv0;to=https://target.test"},
+			"docker.test":  {"v=txtv1;type=dockerv2;to=https://gcr.io/;root=https://root.test"},
+		}),
+		logger: newLogger(&buf, logLevels[LevelDebug]),
+	}
+	generated := regexp.MustCompile("^[0-9a-f]{32}$")
+	tests := []struct {
+		url      string
+		id       string
+		expected string
+		message  string
+	}{
+		{"https://example.test", "edge-1:42", "edge-1:42", ""},
+		{"https://missing.test", "edge-1:43", "edge-1:43", ""},
+		{"https://example.test", "", "", ""},
+		{"https://example.test", "a b", "", ""},
+		{"https://v0.test", "edge-1:44", "edge-1:44", "txtv0 is not suitable for production"},
+		{"https://docker.test/", "edge-1:45", "edge-1:45", "unrecognized path for dockerv2: /"},
+	}
+	for _, test := range tests {
+		buf.Reset()
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Header.Set("User-Agent", "Docker-Client/19.03")
+		if test.id != "" {
+			req.Header.Set(RequestIDHeader, test.id)
+		}
+		resp := httptest.NewRecorder()
+		if err := c.Serve(resp, req); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+
+		id := resp.Header().Get(RequestIDHeader)
+		if test.expected != "" && id != test.expected || test.expected == "" && !generated.MatchString(id) {
+			t.Errorf("Unexpected request ID %q for %q", id, test.id)
+		}
+		lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+		logged := test.message == ""
+		for _, line := range lines {
+			var event map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &event); err != nil {
+				t.Fatalf("Couldn't decode %s: %s", line, err)
+			}
+			if event["request_id"] != id {
+				t.Errorf("Expected the request ID %s in %s", id, line)
+			}
+			if event["msg"] == test.message {
+				logged = true
+			}
+		}
+		if !logged {
+			t.Errorf("Expected %q to be logged for %s, got:\n%s", test.message, test.url, buf.String())
+		}
+	}
+}
+
+func TestRequestIDProxy(t *testing.T) {
+	var upstreamID string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamID = r.Header.Get(RequestIDHeader)
+		w.Header().Set(RequestIDHeader, "upstream")
+		w.Write([]byte("proxied"))
+	}))
+	defer upstream.Close()
+
+	c := Config{
+		Enable: []string{"proxy"},
+		Source: NewStaticSource(map[string][]string{
+			"proxy.test": {"v=txtv1;type=proxy;to=" + upstream.URL},
+		}),
+	}
+	for _, id := range []string{"edge-1:42", ""} {
+		req := httptest.NewRequest("GET", "https://proxy.test", nil)
+		if id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
+		resp := httptest.NewRecorder()
+		if err := c.Serve(resp, req); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if resp.Body.String() != "proxied" {
+			t.Fatalf("Expected the request to be proxied, got %d %s", resp.Code, resp.Body)
+		}
+		responseID := resp.Header().Get(RequestIDHeader)
+		if id != "" && responseID != id || responseID == "" {
+			t.Errorf("Unexpected request ID %q for %q", responseID, id)
+		}
+		if upstreamID != responseID {
+			t.Errorf("Expected the upstream to get %s, got %s", responseID, upstreamID)
+		}
+	}
+}
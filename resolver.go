@@ -0,0 +1,277 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	resolvConf        = "/etc/resolv.conf"
+	defaultDNSPort    = "53"
+	defaultDoTPort    = "853"
+	defaultSystemAddr = "127.0.0.1:53"
+	dohMediaType      = "application/dns-message"
+	dohMaxSize        = 65535
+	// lookupTimeout bounds the lookups that are shared between requests
+	lookupTimeout = 5 * time.Second
+)
+
+var (
+	systemResolver     string
+	systemResolverOnce sync.Once
+
+	// dohClient is the HTTP client used to query DNS-over-HTTPS resolvers
+	dohClient = &http.Client{Timeout: lookupTimeout}
+	// dotTLSConfig is the base TLS config used to connect to DNS-over-TLS
+	// resolvers. The server name is set per resolver.
+	dotTLSConfig = &tls.Config{}
+)
+
+// negativeAnswer is returned when the resolver answers that the zone
+// or its TXT records don't exist. TTL is the negative caching TTL taken
+// from the SOA record in the authority section.
+type negativeAnswer struct {
+	zone   string
+	addr   string
+	reason string
+	ttl    time.Duration
+}
+
+func (n *negativeAnswer) Error() string {
+	return fmt.Sprintf("lookup %s on %s: %s", n.zone, n.addr, n.reason)
+}
+
+// resolverAddress returns the address of the DNS resolver that should
+// be used for the given txtdirect config. It falls back to the first
+// nameserver in the system's resolv.conf when no resolver is configured.
+func resolverAddress(c Config) string {
+	if c.Resolver != "" {
+		return normalizeResolver(c.Resolver)
+	}
+	systemResolverOnce.Do(func() {
+		systemResolver = defaultSystemAddr
+		conf, err := dns.ClientConfigFromFile(resolvConf)
+		if err != nil || len(conf.Servers) == 0 {
+			return
+		}
+		systemResolver = net.JoinHostPort(conf.Servers[0], conf.Port)
+	})
+	return systemResolver
+}
+
+// normalizeResolver adds the default port to the given resolver if it's
+// missing. DNS-over-HTTPS URLs are returned as they are.
+func normalizeResolver(resolver string) string {
+	switch {
+	case strings.HasPrefix(resolver, "https://"):
+		return resolver
+	case strings.HasPrefix(resolver, "tls://"):
+		addr := strings.TrimPrefix(resolver, "tls://")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(addr, defaultDoTPort)
+		}
+		return "tls://" + addr
+	}
+	if _, _, err := net.SplitHostPort(resolver); err != nil {
+		return net.JoinHostPort(resolver, defaultDNSPort)
+	}
+	return resolver
+}
+
+// exchange sends the given DNS message to the resolver and returns its
+// response. The resolver can be a plain host:port address, a tls://
+// address for DNS-over-TLS (RFC 7858) or an https:// URL for
+// DNS-over-HTTPS (RFC 8484).
+func exchange(ctx context.Context, m *dns.Msg, resolver string) (*dns.Msg, error) {
+	if strings.HasPrefix(resolver, "https://") {
+		return exchangeHTTPS(ctx, m, resolver)
+	}
+
+	if strings.HasPrefix(resolver, "tls://") {
+		addr := strings.TrimPrefix(resolver, "tls://")
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig := dotTLSConfig.Clone()
+		tlsConfig.ServerName = host
+		client := dns.Client{Net: "tcp-tls", TLSConfig: tlsConfig}
+		resp, _, err := client.ExchangeContext(ctx, m, addr)
+		return resp, err
+	}
+
+	client := dns.Client{Net: "udp"}
+	resp, _, err := client.ExchangeContext(ctx, m, resolver)
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, m, resolver)
+	}
+	return resp, err
+}
+
+// exchangeHTTPS sends the given DNS message to a DNS-over-HTTPS resolver
+// using the POST method as described in RFC 8484
+func exchangeHTTPS(ctx context.Context, m *dns.Msg, url string) (*dns.Msg, error) {
+	// The ID should be zero to make the responses cache friendly
+	query := m.Copy()
+	query.Id = 0
+	msg, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+
+	resp, err := dohClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS server returned %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dohMediaType {
+		return nil, fmt.Errorf("DNS-over-HTTPS server returned unexpected content type %q", ct)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dohMaxSize))
+	if err != nil {
+		return nil, err
+	}
+
+	answer := new(dns.Msg)
+	if err := answer.Unpack(body); err != nil {
+		return nil, err
+	}
+	answer.Id = m.Id
+	return answer, nil
+}
+
+// lookupTXT sends a TXT query for the given absolute zone to the
+// configured resolver and returns the TXT records along with the
+// lowest TTL among the answers
+func lookupTXT(ctx context.Context, zone string, c Config) ([]string, time.Duration, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(zone, dns.TypeTXT)
+	c.DNSSEC.prepare(m)
+
+	resp, addr, err := c.Resolvers.exchange(ctx, m, c)
+	if err != nil {
+		return nil, 0, fmt.Errorf("lookup %s on %s: %s", zone, addr, err)
+	}
+	if resp.Rcode == dns.RcodeNameError {
+		return nil, 0, &negativeAnswer{zone, addr, dns.RcodeToString[resp.Rcode], negativeTTL(resp, c)}
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return nil, 0, fmt.Errorf("lookup %s on %s: %s", zone, addr, dns.RcodeToString[resp.Rcode])
+	}
+
+	// The answer is owned by the end of the zone's CNAME chain. Only the
+	// zone's own records are validated, so the chain isn't followed then.
+	owner, chain := zone, []*dns.CNAME(nil)
+	if c.DNSSEC.Mode != "validate" {
+		owner, chain = followCNAME(resp.Answer, zone)
+	}
+
+	var txts []string
+	var ttl uint32
+	for _, rr := range resp.Answer {
+		// The records of other owners aren't the answer to the query
+		txt, ok := rr.(*dns.TXT)
+		if !ok || !strings.EqualFold(txt.Hdr.Name, owner) {
+			continue
+		}
+		// A single TXT RR can carry several character-strings
+		txts = append(txts, strings.Join(txt.Txt, ""))
+		if len(txts) == 1 || txt.Hdr.Ttl < ttl {
+			ttl = txt.Hdr.Ttl
+		}
+	}
+	if len(txts) == 0 {
+		return nil, 0, &negativeAnswer{zone, addr, "no TXT records found", negativeTTL(resp, c)}
+	}
+	for _, cname := range chain {
+		if cname.Hdr.Ttl < ttl {
+			ttl = cname.Hdr.Ttl
+		}
+	}
+	if err := c.DNSSEC.check(ctx, zone, resp, c); err != nil {
+		return nil, 0, fmt.Errorf("lookup %s on %s: DNSSEC validation failed: %s", zone, addr, err)
+	}
+
+	return txts, time.Duration(ttl) * time.Second, nil
+}
+
+// followCNAME follows the CNAME chain of the name in the answer section
+// and returns the name at its end along with the CNAME records of the chain
+func followCNAME(answer []dns.RR, name string) (string, []*dns.CNAME) {
+	var chain []*dns.CNAME
+	// A loop stops once there are more links than records
+	for len(chain) < len(answer) {
+		var next *dns.CNAME
+		for _, rr := range answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				next = cname
+				break
+			}
+		}
+		if next == nil {
+			break
+		}
+		chain = append(chain, next)
+		name = next.Target
+	}
+	return name, chain
+}
+
+// negativeTTL returns the TTL that a negative answer can be cached
+// for, which is the lower of the SOA record's TTL and its minimum field
+// as described in RFC 2308. It returns zero when there's no SOA record
+// or when DNSSEC is enabled, since the denial of existence isn't validated.
+func negativeTTL(resp *dns.Msg, c Config) time.Duration {
+	if c.DNSSEC.Mode != "" {
+		return 0
+	}
+	for _, rr := range resp.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		ttl := soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+		return time.Duration(ttl) * time.Second
+	}
+	return 0
+}
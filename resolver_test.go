@@ -0,0 +1,252 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohResponseWriter captures the answer written by a dns.Handler
+// so it can be returned as a DNS-over-HTTPS response
+type dohResponseWriter struct {
+	msg *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr       { return &net.TCPAddr{} }
+func (w *dohResponseWriter) RemoteAddr() net.Addr      { return &net.TCPAddr{} }
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	w.msg = new(dns.Msg)
+	return len(b), w.msg.Unpack(b)
+}
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
+
+// RunDoHServer starts a DNS-over-HTTPS stand-in server that answers
+// the queries using the testing DNS handlers
+func RunDoHServer() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rw := &dohResponseWriter{}
+		dns.DefaultServeMux.ServeDNS(rw, req)
+		resp, err := rw.msg.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(resp)
+	}))
+}
+
+// RunDoTServer starts a DNS-over-TLS stand-in server that answers the
+// queries using the testing DNS handlers. It uses the same certificate
+// as the given httptest server.
+func RunDoTServer(t *testing.T, certs *httptest.Server) *dns.Server {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certs.TLS.Certificates})
+	if err != nil {
+		t.Fatalf("Couldn't start the DNS-over-TLS listener: %s", err)
+	}
+	started := make(chan struct{})
+	s := &dns.Server{Listener: l, NotifyStartedFunc: func() { close(started) }}
+	go s.ActivateAndServe()
+	<-started
+	return s
+}
+
+func Test_normalizeResolver(t *testing.T) {
+	tests := []struct {
+		resolver string
+		expected string
+	}{
+		{
+			"127.0.0.1",
+			"127.0.0.1:53",
+		},
+		{
+			"tls://dns.example.test",
+			"tls://dns.example.test:853",
+		},
+		{
+			"tls://127.0.0.1:8853",
+			"tls://127.0.0.1:8853",
+		},
+		{
+			"https://dns.example.test/dns-query",
+			"https://dns.example.test/dns-query",
+		},
+	}
+	for _, test := range tests {
+		if resolver := normalizeResolver(test.resolver); resolver != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, resolver)
+		}
+	}
+}
+
+func Test_queryEncrypted(t *testing.T) {
+	doh := RunDoHServer()
+	defer doh.Close()
+	dot := RunDoTServer(t, doh)
+	defer dot.Shutdown()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(doh.Certificate())
+	defaultClient, defaultTLSConfig := dohClient, dotTLSConfig
+	dohClient, dotTLSConfig = doh.Client(), &tls.Config{RootCAs: pool}
+	defer func() {
+		dohClient, dotTLSConfig = defaultClient, defaultTLSConfig
+	}()
+
+	resolvers := []string{
+		doh.URL + "/dns-query",
+		"tls://" + dot.Listener.Addr().String(),
+	}
+	for _, resolver := range resolvers {
+		c := Config{
+			Resolver: resolver,
+		}
+		for zone, txt := range map[string]string{
+			"_redirect.about.test.": txts["_redirect.about.test."],
+			"_redirect.pkg.test.":   txts["_redirect.pkg.test."],
+		} {
+			resp, err := query(zone, context.Background(), c)
+			if err != nil {
+				t.Fatalf("Couldn't query %s using %s: %s", zone, resolver, err)
+			}
+			if resp[0] != txt {
+				t.Errorf("Expected %s, got %s", txt, resp[0])
+			}
+		}
+	}
+
+	// The resolver's certificate must be trusted
+	dotTLSConfig = &tls.Config{}
+	c := Config{
+		Resolver: "tls://" + dot.Listener.Addr().String(),
+	}
+	if _, err := query("_redirect.about.test.", context.Background(), c); err == nil {
+		t.Errorf("Expected the query to fail with an untrusted certificate")
+	}
+}
+
+func Test_lookupTXTStrings(t *testing.T) {
+	c := Config{
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+	}
+	tests := []struct {
+		zone     string
+		expected []string
+		ttl      time.Duration
+	}{
+		{
+			"_redirect.long.test.",
+			[]string{"v=txtv0;to=https://long.test/" + longPath + ";type=host"},
+			time.Minute,
+		},
+		{
+			"_redirect.multiple.test.",
+			[]string{
+				"v=txtv0;to=https://first.multiple.test;type=host",
+				"v=txtv0;to=https://second.multiple.test;type=host",
+			},
+			time.Minute,
+		},
+		{
+			"_redirect.alias.test.",
+			[]string{"v=txtv0;to=https://shared.test;type=host"},
+			30 * time.Second,
+		},
+		{
+			"_redirect.chain.alias.test.",
+			[]string{"v=txtv0;to=https://shared.test;type=host"},
+			30 * time.Second,
+		},
+	}
+	for _, test := range tests {
+		resp, ttl, err := lookupTXT(context.Background(), test.zone, c)
+		if err != nil {
+			t.Fatalf("Couldn't query %s: %s", test.zone, err)
+		}
+		if ttl != test.ttl {
+			t.Errorf("Expected the TTL %s for %s, got %s", test.ttl, test.zone, ttl)
+		}
+		if len(resp) != len(test.expected) {
+			t.Fatalf("Expected %d records for %s, got %d", len(test.expected), test.zone, len(resp))
+		}
+		for i := range resp {
+			if resp[i] != test.expected[i] {
+				t.Errorf("Expected %s, got %s", test.expected[i], resp[i])
+			}
+		}
+	}
+
+	req := httptest.NewRequest("GET", "https://long.test", nil)
+	rec, err := getRecord(req.Host, context.Background(), Config{Resolver: c.Resolver, Enable: []string{"host"}}, req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if expected := "https://long.test/" + longPath; rec.To != expected {
+		t.Errorf("Expected %s, got %s", expected, rec.To)
+	}
+}
+
+func Test_followCNAME(t *testing.T) {
+	cname := func(name, target string) dns.RR {
+		return &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME}, Target: target}
+	}
+	txt := &dns.TXT{Hdr: dns.RR_Header{Name: "b.test.", Rrtype: dns.TypeTXT}}
+	tests := []struct {
+		answer   []dns.RR
+		expected string
+		links    int
+	}{
+		{[]dns.RR{txt}, "a.test.", 0},
+		{[]dns.RR{cname("A.test.", "b.test."), txt}, "b.test.", 1},
+		{[]dns.RR{txt, cname("b.test.", "c.test."), cname("a.test.", "b.test.")}, "c.test.", 2},
+		{[]dns.RR{cname("a.test.", "b.test."), cname("b.test.", "a.test.")}, "a.test.", 2},
+	}
+	for i, test := range tests {
+		name, chain := followCNAME(test.answer, "a.test.")
+		if name != test.expected || len(chain) != test.links {
+			t.Errorf("Test %d: expected %s after %d links, got %s after %d", i, test.expected, test.links, name, len(chain))
+		}
+	}
+}
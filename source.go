@@ -0,0 +1,147 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// RecordSource provides the TXT records of the redirect zones
+type RecordSource interface {
+	// LookupTXT returns the TXT records of the given absolute zone,
+	// e.g. "_redirect.example.com."
+	LookupTXT(ctx context.Context, zone string, c Config) ([]string, error)
+}
+
+// DNSSource looks the records up using the configured DNS resolvers.
+// It's the default source when Config.Source is nil.
+type DNSSource struct{}
+
+// LookupTXT queries the resolvers for the TXT records of the zone
+func (DNSSource) LookupTXT(ctx context.Context, zone string, c Config) ([]string, error) {
+	return query(zone, ctx, c)
+}
+
+// StaticSource serves TXT records from memory. The keys are the
+// absolute redirect zones in lowercase.
+type StaticSource map[string][]string
+
+// LookupTXT returns the TXT records stored for the zone
+func (s StaticSource) LookupTXT(ctx context.Context, zone string, c Config) ([]string, error) {
+	txts, ok := s[strings.ToLower(zone)]
+	if !ok || len(txts) == 0 {
+		return nil, fmt.Errorf("could not get TXT record: no TXT records found for %s", zone)
+	}
+	return txts, nil
+}
+
+// NewStaticSource returns a StaticSource for the given records. The
+// keys can be either the hosts or their redirect zones.
+func NewStaticSource(records map[string][]string) StaticSource {
+	s := make(StaticSource)
+	for zone, txts := range records {
+		zone = strings.ToLower(absoluteZone(zone))
+		s[zone] = append(s[zone], txts...)
+	}
+	return s
+}
+
+// NewZoneFileSource reads the TXT records of an RFC 1035 zone file.
+// Relative names in the file are relative to the given origin unless
+// the file sets its own $ORIGIN.
+func NewZoneFileSource(path, origin string) (StaticSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open the zone file: %s", err)
+	}
+	defer f.Close()
+
+	if origin == "" {
+		origin = "."
+	}
+	s := make(StaticSource)
+	zp := dns.NewZoneParser(f, dns.Fqdn(origin), path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		zone := canonicalName(txt.Hdr.Name)
+		// Character strings of a single record are concatenated
+		s[zone] = append(s[zone], strings.Join(txt.Txt, ""))
+	}
+	if err := zp.Err(); err != nil {
+		return nil, fmt.Errorf("couldn't parse the zone file: %s", err)
+	}
+	return s, nil
+}
+
+// NewMapFileSource reads the TXT records of a YAML or JSON file which
+// maps the hosts or their redirect zones to a single record or a list
+// of records, e.g.:
+//
+//	example.com: "v=txtv0;to=https://example.org;type=host"
+//	_redirect.example.net:
+//	  - "v=txtv0;to=https://example.org;type=host"
+func NewMapFileSource(path string) (StaticSource, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the map file: %s", err)
+	}
+
+	// JSON is a subset of YAML, so both formats are parsed the same way
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("couldn't parse the map file: %s", err)
+	}
+
+	records := make(map[string][]string)
+	for zone, value := range raw {
+		switch v := value.(type) {
+		case string:
+			records[zone] = []string{v}
+		case []interface{}:
+			for _, item := range v {
+				txt, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("couldn't parse the map file: record %v of %s is not a string", item, zone)
+				}
+				records[zone] = append(records[zone], txt)
+			}
+		default:
+			return nil, fmt.Errorf("couldn't parse the map file: records of %s must be a string or a list of strings", zone)
+		}
+	}
+	return NewStaticSource(records), nil
+}
+
+// lookup finds the TXT records of the given host or zone using the
+// configured record source
+func lookup(zone string, ctx context.Context, c Config) ([]string, error) {
+	source := c.Source
+	if source == nil {
+		source = DNSSource{}
+	}
+	zone = absoluteZone(zone)
+	txts, err := source.LookupTXT(ctx, zone, c)
+	traceFrom(ctx).query(zone, txts, err)
+	return txts, err
+}
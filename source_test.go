@@ -0,0 +1,176 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testZoneFile = `$ORIGIN source.test.
+$TTL 3600
+@                IN SOA  ns.source.test. admin.source.test. 1 7200 3600 1209600 3600
+_redirect        IN TXT  "v=txtv0;to=https://zone.source.test;type=host"
+_redirect.split  IN TXT  "v=txtv0;to=https://split" ".source.test;type=host"
+_redirect.multi  IN TXT  "v=txtv0;to=https://first.source.test;type=host"
+_redirect.multi  IN TXT  "v=txtv0;to=https://second.source.test;type=host"
+www              IN A    127.0.0.1
+`
+
+const testMapFileYAML = `
+source.test: "v=txtv0;to=https://map.source.test;type=path"
+_redirect.docs.source.test.:
+  - "v=txtv0;to=https://docs.source.test;type=host"
+_redirect.path.source.test: "v=txtv0;to=https://path.source.test;type=host"
+`
+
+const testMapFileJSON = `{
+	"source.test": "v=txtv0;to=https://map.source.test;type=path",
+	"_redirect.docs.source.test.": ["v=txtv0;to=https://docs.source.test;type=host"],
+	"_redirect.path.source.test": "v=txtv0;to=https://path.source.test;type=host"
+}`
+
+// writeTestFile writes the content to a temporary file with the given name
+// and returns its path along with a cleanup function
+func writeTestFile(t *testing.T, name, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "txtdirect")
+	if err != nil {
+		t.Fatalf("Couldn't create the temporary directory: %s", err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Couldn't write the temporary file: %s", err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestZoneFileSource(t *testing.T) {
+	path, cleanup := writeTestFile(t, "source.test.zone", testZoneFile)
+	defer cleanup()
+
+	source, err := NewZoneFileSource(path, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	tests := []struct {
+		host     string
+		expected []string
+	}{
+		{"source.test", []string{"v=txtv0;to=https://zone.source.test;type=host"}},
+		{"SPLIT.source.test", []string{"v=txtv0;to=https://split.source.test;type=host"}},
+		{"multi.source.test", []string{
+			"v=txtv0;to=https://first.source.test;type=host",
+			"v=txtv0;to=https://second.source.test;type=host",
+		}},
+		{"www.source.test", nil},
+	}
+	for _, test := range tests {
+		txts, err := source.LookupTXT(context.Background(), absoluteZone(test.host), Config{})
+		if test.expected == nil {
+			if err == nil {
+				t.Errorf("Expected an error for %s, got %v", test.host, txts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", test.host, err)
+			continue
+		}
+		if len(txts) != len(test.expected) {
+			t.Errorf("Expected %d records for %s, got %d", len(test.expected), test.host, len(txts))
+			continue
+		}
+		for i := range txts {
+			if txts[i] != test.expected[i] {
+				t.Errorf("Expected %s, got %s", test.expected[i], txts[i])
+			}
+		}
+	}
+
+	if _, err := NewZoneFileSource(filepath.Join(filepath.Dir(path), "missing.zone"), ""); err == nil {
+		t.Errorf("Expected an error for a missing zone file")
+	}
+}
+
+func TestMapFileSource(t *testing.T) {
+	for name, content := range map[string]string{
+		"records.yaml": testMapFileYAML,
+		"records.json": testMapFileJSON,
+	} {
+		path, cleanup := writeTestFile(t, name, content)
+		source, err := NewMapFileSource(path)
+		cleanup()
+		if err != nil {
+			t.Fatalf("%s: Unexpected error: %s", name, err)
+		}
+		for zone, expected := range map[string]string{
+			"_redirect.source.test.":      "v=txtv0;to=https://map.source.test;type=path",
+			"_redirect.docs.source.test.": "v=txtv0;to=https://docs.source.test;type=host",
+			"_redirect.path.source.test.": "v=txtv0;to=https://path.source.test;type=host",
+		} {
+			txts, err := source.LookupTXT(context.Background(), zone, Config{})
+			if err != nil {
+				t.Errorf("%s: Unexpected error for %s: %s", name, zone, err)
+				continue
+			}
+			if len(txts) != 1 || txts[0] != expected {
+				t.Errorf("%s: Expected %s for %s, got %v", name, expected, zone, txts)
+			}
+		}
+	}
+
+	path, cleanup := writeTestFile(t, "invalid.yaml", "source.test:\n  key: value\n")
+	defer cleanup()
+	if _, err := NewMapFileSource(path); err == nil {
+		t.Errorf("Expected an error for records that aren't strings")
+	}
+}
+
+func TestSourceE2e(t *testing.T) {
+	path, cleanup := writeTestFile(t, "records.yaml", testMapFileYAML)
+	defer cleanup()
+	source, err := NewMapFileSource(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	// Nothing answers on the resolver, so the records must come from the source
+	c := Config{
+		Enable:   []string{"host", "path"},
+		Resolver: deadResolver,
+		Source:   source,
+	}
+	tests := []struct {
+		url      string
+		expected string
+	}{
+		{"https://docs.source.test", "https://docs.source.test"},
+		{"https://source.test/path", "https://path.source.test"},
+		{"https://source.test/missing", "https://map.source.test"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		resp := httptest.NewRecorder()
+		if err := c.Serve(resp, req); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if location := resp.Header().Get("Location"); location != test.expected {
+			t.Errorf("Expected %s to redirect to %s, got %s", test.url, test.expected, location)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// stickyCookie is the prefix of the cookies that keep the index of
+	// the target chosen for the client
+	stickyCookie    = "txtdirect_target"
+	stickyCookieAge = 30 * 24 * 60 * 60
+)
+
+// selectTarget picks one of the record's targets based on their weights.
+// Sticky records keep sending a client to the same target either by a
+// cookie or by the hash of the client's IP address. The IP address is the
+// address of the connection, so behind a load balancer or a proxy all of
+// the clients get the same target and sticky=cookie has to be used.
+func selectTarget(w http.ResponseWriter, r *http.Request, rec Record) string {
+	// The targets keep their placeholders so the sticky cookie is the
+	// same on every path. They were checked when the record was parsed.
+	to, _ := parsePlaceholders(rec.Targets[pickTarget(w, r, rec)], r, []string{})
+	return to
+}
+
+// pickTarget returns the index of the target that's used for the request
+func pickTarget(w http.ResponseWriter, r *http.Request, rec Record) int {
+	weights := rec.Weights
+	if len(weights) == 0 {
+		weights = make([]int, len(rec.Targets))
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+	total := totalWeight(weights)
+
+	switch rec.Sticky {
+	case "cookie":
+		name := stickyCookieName(rec.Targets)
+		if cookie, err := r.Cookie(name); err == nil {
+			i, err := strconv.Atoi(cookie.Value)
+			if err == nil && i >= 0 && i < len(rec.Targets) && weights[i] > 0 {
+				return i
+			}
+		}
+		i := pickWeighted(weights, rand.Intn(total))
+		http.SetCookie(w, &http.Cookie{
+			Name:   name,
+			Value:  strconv.Itoa(i),
+			Path:   "/",
+			MaxAge: stickyCookieAge,
+		})
+		return i
+	case "ip":
+		h := fnv.New32a()
+		h.Write([]byte(clientIP(r)))
+		return pickWeighted(weights, int(h.Sum32()%uint32(total)))
+	}
+	return pickWeighted(weights, rand.Intn(total))
+}
+
+// stickyCookieName returns the name of the sticky cookie of the targets.
+// Each target list gets its own cookie, so the records of a host don't
+// share their indexes and the cookies are dropped when the targets change.
+func stickyCookieName(targets []string) string {
+	h := fnv.New32a()
+	for _, to := range targets {
+		h.Write([]byte(to))
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%s_%08x", stickyCookie, h.Sum32())
+}
+
+// pickWeighted returns the index of the weight bucket that n falls in,
+// n must be less than the total weight
+func pickWeighted(weights []int, n int) int {
+	for i, w := range weights {
+		if n < w {
+			return i
+		}
+		n -= w
+	}
+	return len(weights) - 1
+}
+
+func totalWeight(weights []int) int {
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	return total
+}
+
+// clientIP returns the IP address of the request's client
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseTargets(t *testing.T) {
+	tests := []struct {
+		txt     string
+		targets []string
+		weights []int
+		sticky  string
+		err     bool
+	}{
+		{
+			"v=txtv0;to=https://a.example;to=https://b.example;weight=90,10",
+			[]string{"https://a.example", "https://b.example"},
+			[]int{90, 10},
+			"",
+			false,
+		},
+		{
+			"v=txtv0;to=https://a.example;to=https://b.example;sticky=cookie",
+			[]string{"https://a.example", "https://b.example"},
+			nil,
+			"cookie",
+			false,
+		},
+		{"v=txtv0;to=https://a.example;to=https://b.example;weight=90", nil, nil, "", true},
+		{"v=txtv0;to=https://a.example;to=https://b.example;weight=0,0", nil, nil, "", true},
+		{"v=txtv0;to=https://a.example;to=https://b.example;weight=-1,2", nil, nil, "", true},
+		{"v=txtv0;to=https://a.example;to=https://b.example;sticky=session", nil, nil, "", true},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("GET", "https://example.test", nil)
+		rec := Record{}
+		err := rec.Parse(test.txt, req, Config{Enable: []string{"host"}})
+		if test.err {
+			if err == nil {
+				t.Errorf("Test %d: Expected an error", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: Unexpected error: %s", i, err)
+		}
+		if rec.To != test.targets[0] {
+			t.Errorf("Test %d: Expected To to be the first target %s, got %s", i, test.targets[0], rec.To)
+		}
+		if len(rec.Targets) != len(test.targets) || len(rec.Weights) != len(test.weights) {
+			t.Fatalf("Test %d: Expected %v and %v, got %v and %v", i, test.targets, test.weights, rec.Targets, rec.Weights)
+		}
+		for j := range test.weights {
+			if rec.Weights[j] != test.weights[j] {
+				t.Errorf("Test %d: Expected weights %v, got %v", i, test.weights, rec.Weights)
+			}
+		}
+		if rec.Sticky != test.sticky {
+			t.Errorf("Test %d: Expected sticky to be %s, got %s", i, test.sticky, rec.Sticky)
+		}
+	}
+}
+
+func Test_pickWeighted(t *testing.T) {
+	tests := []struct {
+		weights  []int
+		n        int
+		expected int
+	}{
+		{[]int{90, 10}, 0, 0},
+		{[]int{90, 10}, 89, 0},
+		{[]int{90, 10}, 90, 1},
+		{[]int{90, 10}, 99, 1},
+		{[]int{0, 10}, 0, 1},
+		{[]int{1, 1, 1}, 2, 2},
+	}
+	for _, test := range tests {
+		if i := pickWeighted(test.weights, test.n); i != test.expected {
+			t.Errorf("Expected %d for %d in %v, got %d", test.expected, test.n, test.weights, i)
+		}
+	}
+}
+
+func Test_selectTarget(t *testing.T) {
+	rec := Record{
+		Targets: []string{"https://a.example", "https://b.example"},
+		Weights: []int{0, 100},
+	}
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest("GET", "https://example.test", nil)
+		if to := selectTarget(httptest.NewRecorder(), req, rec); to != "https://b.example" {
+			t.Fatalf("Expected the only weighted target, got %s", to)
+		}
+	}
+
+	// The same client always gets the same target
+	rec = Record{
+		Targets: []string{"https://a.example", "https://b.example", "https://c.example"},
+		Sticky:  "ip",
+	}
+	req := httptest.NewRequest("GET", "https://example.test", nil)
+	req.RemoteAddr = "203.0.113.7:4321"
+	first := selectTarget(httptest.NewRecorder(), req, rec)
+	for i := 0; i < 20; i++ {
+		req.RemoteAddr = "203.0.113.7:" + strconv.Itoa(40000+i)
+		if to := selectTarget(httptest.NewRecorder(), req, rec); to != first {
+			t.Fatalf("Expected the client to stick to %s, got %s", first, to)
+		}
+	}
+
+	rec.Sticky = "cookie"
+	resp := httptest.NewRecorder()
+	first = selectTarget(resp, httptest.NewRequest("GET", "https://example.test", nil), rec)
+	cookies := resp.Result().Cookies()
+	name := stickyCookieName(rec.Targets)
+	if len(cookies) != 1 || cookies[0].Name != name {
+		t.Fatalf("Expected the %s cookie to be set, got %v", name, cookies)
+	}
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest("GET", "https://example.test", nil)
+		req.AddCookie(&http.Cookie{Name: name, Value: cookies[0].Value})
+		if to := selectTarget(httptest.NewRecorder(), req, rec); to != first {
+			t.Fatalf("Expected the client to stick to %s, got %s", first, to)
+		}
+	}
+
+	// The cookie of another target list isn't used, so the client gets
+	// a new cookie for this record
+	other := Record{
+		Targets: []string{"https://x.example", "https://y.example"},
+		Sticky:  "cookie",
+	}
+	req = httptest.NewRequest("GET", "https://example.test", nil)
+	req.AddCookie(&http.Cookie{Name: name, Value: "1"})
+	resp = httptest.NewRecorder()
+	selectTarget(resp, req, other)
+	if cookies := resp.Result().Cookies(); len(cookies) != 1 || cookies[0].Name != stickyCookieName(other.Targets) {
+		t.Errorf("Expected a cookie of the record's own, got %v", cookies)
+	}
+}
+
+func Test_stickyCookieName(t *testing.T) {
+	a := stickyCookieName([]string{"https://a.example", "https://b.example"})
+	if !strings.HasPrefix(a, stickyCookie+"_") {
+		t.Errorf("Expected the %s prefix, got %s", stickyCookie, a)
+	}
+	for _, targets := range [][]string{
+		{"https://b.example", "https://a.example"},
+		{"https://a.example", "https://b.example", "https://c.example"},
+		{"https://a.examplehttps://b.example"},
+	} {
+		if name := stickyCookieName(targets); name == a {
+			t.Errorf("Expected %v to get its own cookie, got %s", targets, name)
+		}
+	}
+}
+
+func TestWeightedTargetsE2e(t *testing.T) {
+	c := Config{
+		Enable: []string{"host"},
+		Source: NewStaticSource(map[string][]string{
+			"canary.test": {"v=txtv0;to=https://stable.canary.test;to=https://canary.canary.test;weight=0,1;code=302"},
+			"sticky.test": {"v=txtv0;to=https://a.sticky.test;to=https://b.sticky.test;sticky=cookie"},
+			"uri.test":    {"v=txtv0;to=https://a.uri.test{uri};to=https://b.uri.test{uri};sticky=cookie"},
+		}),
+	}
+
+	req := httptest.NewRequest("GET", "https://canary.test", nil)
+	resp := httptest.NewRecorder()
+	if err := c.Serve(resp, req); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if location := resp.Header().Get("Location"); location != "https://canary.canary.test" {
+		t.Errorf("Expected the canary target, got %s", location)
+	}
+
+	req = httptest.NewRequest("GET", "https://sticky.test", nil)
+	resp = httptest.NewRecorder()
+	if err := c.Serve(resp, req); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if cookie := resp.Header().Get("Set-Cookie"); cookie == "" {
+		t.Errorf("Expected the sticky cookie to be set")
+	}
+
+	// The targets with placeholders keep the same cookie on every path
+	req = httptest.NewRequest("GET", "https://uri.test/a", nil)
+	resp = httptest.NewRecorder()
+	if err := c.Serve(resp, req); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	cookies := resp.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected the sticky cookie to be set, got %v", cookies)
+	}
+	first := resp.Header().Get("Location")
+	if !strings.HasSuffix(first, ".uri.test/a") {
+		t.Errorf("Expected a target with the request's path, got %s", first)
+	}
+	req = httptest.NewRequest("GET", "https://uri.test/b", nil)
+	req.AddCookie(cookies[0])
+	resp = httptest.NewRecorder()
+	if err := c.Serve(resp, req); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if cookie := resp.Header().Get("Set-Cookie"); cookie != "" {
+		t.Errorf("Expected the cookie of /a to be used on /b, got a new one %s", cookie)
+	}
+	if location := resp.Header().Get("Location"); location != strings.TrimSuffix(first, "/a")+"/b" {
+		t.Errorf("Expected the target of /a with the path /b, got %s", location)
+	}
+}
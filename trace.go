@@ -0,0 +1,176 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+)
+
+// TraceHeader is the request header that asks for the trace of the
+// request instead of the redirect. Its value must match Config.TraceToken.
+const TraceHeader = "X-TXTDirect-Trace"
+
+// Trace describes how a request is resolved
+type Trace struct {
+	Host         string             `json:"host"`
+	Path         string             `json:"path"`
+	Queries      []TraceQuery       `json:"queries"`
+	Placeholders []TracePlaceholder `json:"placeholders"`
+	Records      []Record           `json:"records"`
+	Decision     TraceDecision      `json:"decision"`
+}
+
+// TraceQuery is a lookup of a zone and its raw TXT answers
+type TraceQuery struct {
+	Zone    string   `json:"zone"`
+	Answers []string `json:"answers"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// TracePlaceholder is a value with its placeholders expanded
+type TracePlaceholder struct {
+	Input  string `json:"input"`
+	Output string `json:"output"`
+}
+
+// TraceDecision is the response that would have been sent
+type TraceDecision struct {
+	Status   int    `json:"status"`
+	Location string `json:"location,omitempty"`
+	// Fallback is the type of the used fallback, e.g. to or global
+	Fallback string `json:"fallback,omitempty"`
+	// Reason explains why the request fell back or wasn't redirected
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type traceKey struct{}
+
+// traceFrom returns the trace of the request's context, the methods of
+// the returned trace are no-ops when the request isn't traced
+func traceFrom(ctx context.Context) *Trace {
+	t, _ := ctx.Value(traceKey{}).(*Trace)
+	return t
+}
+
+func (t *Trace) query(zone string, txts []string, err error) {
+	if t == nil {
+		return
+	}
+	q := TraceQuery{Zone: zone, Answers: txts}
+	if err != nil {
+		q.Error = err.Error()
+	}
+	t.Queries = append(t.Queries, q)
+}
+
+func (t *Trace) placeholder(input, output string) {
+	if t == nil || input == output {
+		return
+	}
+	t.Placeholders = append(t.Placeholders, TracePlaceholder{input, output})
+}
+
+func (t *Trace) record(rec Record) {
+	if t == nil {
+		return
+	}
+	t.Records = append(t.Records, rec)
+}
+
+// reason keeps the first reason, the later ones are caused by it
+func (t *Trace) reason(reason string) {
+	if t == nil || t.Decision.Reason != "" {
+		return
+	}
+	t.Decision.Reason = reason
+}
+
+func (t *Trace) fallback(fallbackType string) {
+	if t == nil {
+		return
+	}
+	t.Decision.Fallback = fallbackType
+}
+
+// traceWriter keeps the status and the headers of the response
+// and discards its body
+type traceWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *traceWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *traceWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (w *traceWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// validTraceToken checks the token of the trace header in constant time
+// so the configured token can't be guessed from the response times
+func (c Config) validTraceToken(token string) bool {
+	return c.TraceToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(c.TraceToken)) == 1
+}
+
+// serveTrace resolves the request without redirecting it and
+// responds with the trace of the resolution as JSON
+func (c Config) serveTrace(w http.ResponseWriter, r *http.Request) error {
+	if rl := requestLogFrom(r.Context()); rl != nil {
+		rl.traced = true
+	}
+	t := &Trace{
+		Host:         r.Host,
+		Path:         r.URL.Path,
+		Queries:      []TraceQuery{},
+		Placeholders: []TracePlaceholder{},
+		Records:      []Record{},
+	}
+
+	// The token must not end up in the placeholders of the records
+	header := make(http.Header, len(r.Header))
+	for k, v := range r.Header {
+		if http.CanonicalHeaderKey(k) != http.CanonicalHeaderKey(TraceHeader) {
+			header[k] = v
+		}
+	}
+	req := r.WithContext(context.WithValue(r.Context(), traceKey{}, t))
+	req.Header = header
+
+	tw := &traceWriter{header: make(http.Header)}
+	if err := c.Serve(tw, req); err != nil {
+		t.Decision.Error = err.Error()
+	}
+	t.Decision.Status = tw.status
+	t.Decision.Location = tw.header.Get("Location")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(t)
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestTraceE2e(t *testing.T) {
+	c := Config{
+		Enable:     []string{"host", "path", "proxy"},
+		Redirect:   "https://fallback.test",
+		TraceToken: "secret",
+		Source: NewStaticSource(map[string][]string{
+			"path.test":                {"v=txtv1;type=path;to=https://path.test"},
+			"_redirect.docs.path.test": {"v=txtv1;to=https://docs.test/{>X-Id}"},
+			"_redirect._.path.test":    {"v=txtv1;to=https://wildcard.test"},
+			"proxy.test":               {"v=txtv1;type=proxy;to=https://upstream.invalid"},
+		}),
+	}
+	tests := []struct {
+		url          string
+		queries      []string
+		placeholders []TracePlaceholder
+		decision     TraceDecision
+	}{
+		{
+			"https://path.test/docs",
+			[]string{"_redirect.path.test.", "_redirect.docs.path.test."},
+			[]TracePlaceholder{{"https://docs.test/{>X-Id}", "https://docs.test/42"}},
+			TraceDecision{Status: 302, Location: "https://docs.test/42"},
+		},
+		{
+			"https://path.test/blog",
+			[]string{"_redirect.path.test.", "_redirect.blog.path.test.", "_redirect._.path.test."},
+			[]TracePlaceholder{},
+			TraceDecision{Status: 302, Location: "https://wildcard.test"},
+		},
+		{
+			"https://proxy.test",
+			[]string{"_redirect.proxy.test."},
+			[]TracePlaceholder{},
+			TraceDecision{Status: 0, Reason: "the request would be proxied to https://upstream.invalid"},
+		},
+		{
+			"https://missing.test",
+			[]string{"_redirect.missing.test.", "_redirect._.test."},
+			[]TracePlaceholder{},
+			TraceDecision{
+				Status:   301,
+				Location: "https://fallback.test",
+				Fallback: "redirect",
+				Reason:   "could not get TXT record: no TXT records found for _redirect._.test.",
+			},
+		},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Header.Set(TraceHeader, "secret")
+		req.Header.Set("X-Id", "42")
+		resp := httptest.NewRecorder()
+		if err := c.Serve(resp, req); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if location := resp.Header().Get("Location"); location != "" {
+			t.Errorf("Expected %s not to be redirected, got %s", test.url, location)
+		}
+
+		var trace Trace
+		if err := json.Unmarshal(resp.Body.Bytes(), &trace); err != nil {
+			t.Fatalf("Couldn't decode the trace of %s: %s", test.url, err)
+		}
+		var zones []string
+		for _, q := range trace.Queries {
+			zones = append(zones, q.Zone)
+		}
+		if !reflect.DeepEqual(zones, test.queries) {
+			t.Errorf("Expected %s to query %v, got %v", test.url, test.queries, zones)
+		}
+		if !reflect.DeepEqual(trace.Placeholders, test.placeholders) {
+			t.Errorf("Expected %s to expand %v, got %v", test.url, test.placeholders, trace.Placeholders)
+		}
+		if trace.Decision != test.decision {
+			t.Errorf("Expected %s to decide %+v, got %+v", test.url, test.decision, trace.Decision)
+		}
+	}
+
+	// Without the right token the request is redirected
+	req := httptest.NewRequest("GET", "https://path.test/docs", nil)
+	req.Header.Set(TraceHeader, "wrong")
+	req.Header.Set("X-Id", "7")
+	resp := httptest.NewRecorder()
+	if err := c.Serve(resp, req); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if location := resp.Header().Get("Location"); location != "https://docs.test/7" {
+		t.Errorf("Expected a redirect to https://docs.test/7, got %s", location)
+	}
+
+	// The token can't be read by the placeholders
+	req = httptest.NewRequest("GET", "https://path.test/docs", nil)
+	req.Header.Set(TraceHeader, "secret")
+	req.Header.Set("X-Id", "{>X-TXTDirect-Trace}")
+	resp = httptest.NewRecorder()
+	c.Serve(resp, req)
+	var trace Trace
+	if err := json.Unmarshal(resp.Body.Bytes(), &trace); err != nil {
+		t.Fatalf("Couldn't decode the trace: %s", err)
+	}
+	if len(trace.Records) != 2 || trace.Decision.Location == "https://docs.test/secret" {
+		t.Errorf("Unexpected trace: %+v", trace)
+	}
+}
@@ -16,12 +16,12 @@ package minitxtd
 import (
 	"context"
 	"fmt"
-	"log"
-	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
+
+	"golang.org/x/sync/singleflight"
 )
 
 const (
@@ -34,19 +34,64 @@ const (
 	status301CacheAge = 604800
 )
 
+// DefaultPathChainDepth is the default maximum number of nested
+// path records that are followed for a request
+const DefaultPathChainDepth = 5
+
+// AllOptions lists the redirect types that can be enabled
+var AllOptions = []string{"host", "path", "gometa", "www", "proxy", "dockerv2", "gomods"}
+
+// lookups holds the in-flight DNS lookups
+var lookups singleflight.Group
+
 // Config contains the middleware's configuration
 type Config struct {
-	Enable     []string
-	Redirect   string
-	Resolver   string
-	LogOutput  string
+	Enable   []string
+	Redirect string
+	Resolver string
+	// PathChainDepth limits the number of nested path records
+	PathChainDepth int
+	// RefMaxHops limits the number of followed ref= references
+	RefMaxHops int
+	Resolvers  Resolvers
+	DNSSEC     DNSSEC
+	// Source provides the TXT records, the DNS is used when it's nil
+	Source RecordSource
+	// TraceToken enables the traces of the requests that send it in
+	// the X-TXTDirect-Trace header, traces are disabled when it's empty
+	TraceToken string
+	// Hosts override the config for the hosts matching their patterns
+	Hosts []HostConfig
+	// LogOutput enables the JSON logs on stdout, stderr or a file
+	LogOutput string
+	// LogLevel is the minimum level of the JSON logs, info by default
+	LogLevel string
+	// LogRotate configures the rotation of the log file
+	LogRotate  LogRotate
+	Cache      RecordCache
 	Gomods     Gomods
 	Prometheus Prometheus
+
+	logger *Logger
+}
+
+// SetDefaults sets the default values of the sub configs
+// if their fields are empty
+func (c *Config) SetDefaults() {
+	c.Resolvers.SetDefaults()
+	for i := range c.Hosts {
+		if len(c.Hosts[i].Resolvers.Upstreams) != 0 {
+			c.Hosts[i].Resolvers.SetDefaults()
+		}
+	}
+	c.Cache.SetDefaults()
+	c.Gomods.SetDefaults()
+	c.Prometheus.SetDefaults()
 }
 
 // getBaseTarget parses the placeholder in the given record's To= field
 // and returns the final address and http status code
-func getBaseTarget(rec record, r *http.Request) (string, int, error) {
+func getBaseTarget(rec Record, r *http.Request) (string, int, error) {
 	if strings.ContainsAny(rec.To, "{}") {
 		to, err := parsePlaceholders(rec.To, r, []string{})
 		if err != nil {
@@ -72,18 +117,23 @@ func contains(array []string, word string) bool {
 // and if it's not provided it will check txtdirect config for
 // default fallback address
 func fallback(w http.ResponseWriter, r *http.Request, fallback, recordType, fallbackType string, code int, c Config) {
+	trace, rl := traceFrom(r.Context()), requestLogFrom(r.Context())
 	if code == http.StatusMovedPermanently {
 		w.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", status301CacheAge))
 	}
 	w.Header().Add("Status-Code", strconv.Itoa(code))
 
 	if fallback != "" && fallbackType != "global" {
+		trace.fallback(fallbackType)
+		rl.setFallback(fallbackType)
 		http.Redirect(w, r, fallback, code)
 		if c.Prometheus.Enable {
 			FallbacksCount.WithLabelValues(r.Host, recordType, fallbackType).Add(1)
 			RequestsByStatus.WithLabelValues(r.URL.Host, strconv.Itoa(code)).Add(1)
 		}
 	} else if contains(c.Enable, "www") {
+		trace.fallback("subdomain")
+		rl.setFallback("subdomain")
 		s := strings.Join([]string{defaultProtocol, "://", defaultSub, ".", r.URL.Host}, "")
 		http.Redirect(w, r, s, code)
 		if c.Prometheus.Enable {
@@ -91,35 +141,27 @@ func fallback(w http.ResponseWriter, r *http.Request, fallback, recordType, fall
 			RequestsByStatus.WithLabelValues(r.URL.Host, strconv.Itoa(code)).Add(1)
 		}
 	} else if c.Redirect != "" {
+		trace.fallback("redirect")
+		rl.setFallback("redirect")
 		w.Header().Set("Status-Code", strconv.Itoa(http.StatusMovedPermanently))
 
 		http.Redirect(w, r, c.Redirect, http.StatusMovedPermanently)
 
 		if c.Prometheus.Enable {
 			FallbacksCount.WithLabelValues(r.Host, recordType, "redirect").Add(1)
-			RequestsByStatus.WithLabelValues(r.URL.Host, string(http.StatusMovedPermanently)).Add(1)
+			RequestsByStatus.WithLabelValues(r.URL.Host, strconv.Itoa(http.StatusMovedPermanently)).Add(1)
 		}
 	} else {
+		trace.fallback("not-found")
+		rl.setFallback("not-found")
 		http.NotFound(w, r)
 	}
-	log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, w.Header().Get("Location"))
-}
-
-// customResolver returns a net.Resolver instance based
-// on the given txtdirect config to use a custom DNS resolver.
-func customResolver(c Config) net.Resolver {
-	return net.Resolver{
-		PreferGo: true,
-		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-			d := net.Dialer{}
-			return d.DialContext(ctx, network, c.Resolver)
-		},
-	}
+	c.logger.Debugf("%s > %s", r.Host+r.URL.Path, w.Header().Get("Location"))
 }
 
-// query checks the given zone using net.LookupTXT to
-// find TXT records in that zone
-func query(zone string, ctx context.Context, c Config) ([]string, error) {
+// absoluteZone returns the absolute form of the given zone with the
+// redirect base zone prepended and the port removed
+func absoluteZone(zone string) string {
 	// Removes port from zone
 	if strings.Contains(zone, ":") {
 		zoneSlice := strings.Split(zone, ":")
@@ -131,24 +173,67 @@ func query(zone string, ctx context.Context, c Config) ([]string, error) {
 	}
 
 	// Use absolute zone
-	var absoluteZone string
-	if strings.HasSuffix(zone, ".") {
-		absoluteZone = zone
-	} else {
-		absoluteZone = strings.Join([]string{zone, "."}, "")
+	if !strings.HasSuffix(zone, ".") {
+		zone = strings.Join([]string{zone, "."}, "")
 	}
+	return zone
+}
 
-	var txts []string
-	var err error
-	if c.Resolver != "" {
-		net := customResolver(c)
-		txts, err = net.LookupTXT(ctx, absoluteZone)
-	} else {
-		txts, err = net.LookupTXT(absoluteZone)
+// query checks the given zone using the configured resolver to
+// find TXT records in that zone. Answers are served from the record
+// cache while their TTL hasn't expired.
+func query(zone string, ctx context.Context, c Config) ([]string, error) {
+	zone = absoluteZone(zone)
+
+	if res, ok := c.Cache.get(zone); ok {
+		if res.stale && c.Cache.startRefresh(zone) {
+			go func() {
+				defer c.Cache.endRefresh(zone)
+				if res := <-resolveShared(zone, c); res.Err != nil {
+					c.logger.Warnf("couldn't revalidate the stale record for %s: %s", zone, res.Err)
+				}
+			}()
+		}
+		return res.txts, res.err
 	}
+
+	select {
+	case res := <-resolveShared(zone, c):
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.([]string), nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("could not get TXT record: %s", ctx.Err())
+	}
+}
+
+// resolveShared coalesces concurrent lookups of the same zone so only
+// one DNS query per zone is in flight and its answer is shared with
+// every waiter. The shared lookup isn't bound to any request's context
+// since it can outlive the request that started it.
+func resolveShared(zone string, c Config) <-chan singleflight.Result {
+	key := strings.Join([]string{resolverKey(c), zone}, "/")
+	return lookups.DoChan(key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+		defer cancel()
+		return resolve(zone, ctx, c)
+	})
+}
+
+// resolve looks up the given absolute zone and stores the answer
+// in the record cache, including negative answers
+func resolve(zone string, ctx context.Context, c Config) ([]string, error) {
+	txts, ttl, err := lookupTXT(ctx, zone, c)
 	if err != nil {
-		return nil, fmt.Errorf("could not get TXT record: %s", err)
+		neg, negative := err.(*negativeAnswer)
+		err = fmt.Errorf("could not get TXT record: %s", err)
+		if negative {
+			c.Cache.setNegative(zone, err, neg.ttl)
+		}
+		return nil, err
 	}
+	c.Cache.set(zone, txts, ttl)
 	return txts, nil
 }
 
@@ -161,10 +246,34 @@ func isIP(host string) bool {
 	return err == nil
 }
 
-// Serve the request depending on the redirect record found
+// Redirect the request depending on the redirect record found
+func Redirect(w http.ResponseWriter, r *http.Request, c Config) error {
+	return c.Serve(w, r)
+}
+
+// Serve the request depending on the redirect record found. Every
+// request gets an X-Request-ID that's added to its logs and response.
 func (c Config) Serve(w http.ResponseWriter, r *http.Request) error {
+	if requestIDFrom(r.Context()) == "" {
+		var id string
+		r, id = withRequestID(w, r)
+		c.logger = c.logger.With("request_id", id)
+	}
+	if c.logger.structured() && requestLogFrom(r.Context()) == nil {
+		return c.serveLogged(w, r)
+	}
+	return c.serve(w, r)
+}
+
+func (c Config) serve(w http.ResponseWriter, r *http.Request) error {
 	w.Header().Set("Server", "TXTDirect")
 
+	trace := traceFrom(r.Context())
+	if trace == nil && c.validTraceToken(r.Header.Get(TraceHeader)) {
+		return c.serveTrace(w, r)
+	}
+	c = c.forHost(r.Host)
+
 	host := r.Host
 	path := r.URL.Path
 
@@ -173,7 +282,7 @@ func (c Config) Serve(w http.ResponseWriter, r *http.Request) error {
 
 	if bl[path] {
 		redirect := strings.Join([]string{host, path}, "")
-		log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, redirect)
+		c.logger.Debugf("%s > %s", r.Host+r.URL.Path, redirect)
 		// Empty Content-Type to prevent http.Redirect from writing an html response body
 		w.Header().Set("Content-Type", "")
 		w.Header().Add("Status-Code", strconv.Itoa(http.StatusNotFound))
@@ -185,18 +294,24 @@ func (c Config) Serve(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	if isIP(host) {
-		log.Println("[txtdirect]: Trying to access 127.0.0.1, fallback triggered.")
+		c.logger.Debugf("Trying to access 127.0.0.1, fallback triggered.")
+		trace.reason("the host is an IP address")
 		fallback(w, r, "", "", "global", 0, c)
 		return nil
 	}
 
 	rec, err := getRecord(host, r.Context(), c, r)
 	if err != nil {
-		log.Printf("Couldn't parse the record: %s", err.Error())
+		c.logger.Warnf("Couldn't parse the record: %s", err.Error())
+		trace.reason(err.Error())
 		fallback(w, r, "", "", "global", http.StatusFound, c)
 		return nil
 	}
 
+	trace.record(rec)
+	rl := requestLogFrom(r.Context())
+	rl.setType(rec.Type)
+
 	if !contains(c.Enable, rec.Type) {
 		return fmt.Errorf("option disabled")
 	}
@@ -204,7 +319,8 @@ func (c Config) Serve(w http.ResponseWriter, r *http.Request) error {
 	fallbackURL, code := rec.To, rec.Code
 
 	if rec.Re != "" && rec.From != "" {
-		log.Println("[txtdirect]: It's not allowed to use both re= and from= in a record.")
+		c.logger.Warnf("It's not allowed to use both re= and from= in a record.")
+		trace.reason("both re= and from= are used in the record")
 		fallback(w, r, fallbackURL, rec.Type, "to", code, c)
 		return nil
 	}
@@ -214,38 +330,47 @@ func (c Config) Serve(w http.ResponseWriter, r *http.Request) error {
 		PathRedirectCount.WithLabelValues(host, path).Add(1)
 		if path == "/" {
 			if rec.Root == "" {
+				trace.reason("the record has no root= for the / path")
 				fallback(w, r, fallbackURL, rec.Type, "to", code, c)
 				return nil
 			}
-			log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, rec.Root)
-			if rec.Code == http.StatusMovedPermanently {
-				w.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", status301CacheAge))
-			}
-			w.Header().Add("Status-Code", strconv.Itoa(rec.Code))
-			http.Redirect(w, r, rec.Root, rec.Code)
-			if c.Prometheus.Enable {
-				RequestsByStatus.WithLabelValues(host, strconv.Itoa(rec.Code)).Add(1)
-			}
+			c.redirectRoot(w, r, rec, host)
 			return nil
 		}
 
 		if path != "" {
-			zone, from, pathSlice, err := zoneFromPath(host, path, rec)
-			rec, err = getFinalRecord(zone, from, r.Context(), c, r, pathSlice)
+			rec, err = resolvePath(host, path, rec, r.Context(), c, r)
 			if err != nil {
-				log.Print("Fallback is triggered because an error has occurred: ", err)
+				c.logger.Warnf("Fallback is triggered because an error has occurred: %s", err)
+				trace.reason(err.Error())
 				fallback(w, r, fallbackURL, rec.Type, "to", code, c)
 				return nil
 			}
+			rl.setType(rec.Type)
+			// The path ended at a nested path record
+			if rec.Type == "path" {
+				c.redirectRoot(w, r, rec, host)
+				return nil
+			}
 		}
 	}
 
+	if len(rec.Targets) > 1 {
+		rec.To = selectTarget(w, r, rec)
+	}
+
 	if rec.Type == "proxy" {
 		RequestsCountBasedOnType.WithLabelValues(host, "proxy").Add(1)
-		log.Printf("[txtdirect]: %s > %s", rec.From, rec.To)
+		c.logger.Debugf("%s > %s", rec.From, rec.To)
+		rl.setTarget(rec.To)
+
+		if trace != nil {
+			trace.reason("the request would be proxied to " + rec.To)
+			return nil
+		}
 
 		if err = proxyRequest(w, r, rec, c, fallbackURL, code); err != nil {
-			log.Print("Fallback is triggered because an error has occurred: ", err)
+			c.logger.Warnf("Fallback is triggered because an error has occurred: %s", err)
 			fallback(w, r, fallbackURL, rec.Type, "to", code, c)
 		}
 
@@ -256,14 +381,16 @@ func (c Config) Serve(w http.ResponseWriter, r *http.Request) error {
 		RequestsCountBasedOnType.WithLabelValues(host, "dockerv2").Add(1)
 
 		if !strings.Contains(r.Header.Get("User-Agent"), "Docker-Client") {
-			log.Println("[txtdirect]: The request is not from docker client, fallback triggered.")
+			c.logger.Debugf("The request is not from docker client, fallback triggered.")
+			trace.reason("the request is not from a docker client")
 			fallback(w, r, fallbackURL, rec.Type, "to", code, c)
 			return nil
 		}
 
-		err := redirectDockerv2(w, r, rec)
+		err := redirectDockerv2(w, r, rec, c)
 		if err != nil {
-			log.Printf("[txtdirect]: couldn't redirect to the requested container: %s", err.Error())
+			c.logger.Warnf("couldn't redirect to the requested container: %s", err.Error())
+			trace.reason(err.Error())
 			fallback(w, r, fallbackURL, rec.Type, "to", code, c)
 			return nil
 		}
@@ -274,11 +401,12 @@ func (c Config) Serve(w http.ResponseWriter, r *http.Request) error {
 		RequestsCountBasedOnType.WithLabelValues(host, "host").Add(1)
 		to, code, err := getBaseTarget(rec, r)
 		if err != nil {
-			log.Print("Fallback is triggered because an error has occurred: ", err)
+			c.logger.Warnf("Fallback is triggered because an error has occurred: %s", err)
+			trace.reason(err.Error())
 			fallback(w, r, fallbackURL, rec.Type, "to", code, c)
 			return nil
 		}
-		log.Printf("[txtdirect]: %s > %s", r.Host+r.URL.Path, to)
+		c.logger.Debugf("%s > %s", r.Host+r.URL.Path, to)
 		if code == http.StatusMovedPermanently {
 			w.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", status301CacheAge))
 		}
@@ -295,6 +423,7 @@ func (c Config) Serve(w http.ResponseWriter, r *http.Request) error {
 
 		// Trigger fallback when request isn't from `go get`
 		if r.URL.Query().Get("go-get") != "1" {
+			trace.reason("the request is not from go get")
 			fallback(w, r, rec.Website, rec.Type, "website", http.StatusFound, c)
 			return nil
 		}
@@ -303,8 +432,25 @@ func (c Config) Serve(w http.ResponseWriter, r *http.Request) error {
 	}
 
 	if rec.Type == "gomods" {
+		if trace != nil {
+			trace.reason("the request would be served by the Go modules proxy")
+			return nil
+		}
 		return gomods(w, r, path, c)
 	}
 
 	return fmt.Errorf("record type %s unsupported", rec.Type)
 }
+
+// redirectRoot redirects the request to the root= of the path record
+func (c Config) redirectRoot(w http.ResponseWriter, r *http.Request, rec Record, host string) {
+	c.logger.Debugf("%s > %s", r.Host+r.URL.Path, rec.Root)
+	if rec.Code == http.StatusMovedPermanently {
+		w.Header().Add("Cache-Control", fmt.Sprintf("max-age=%d", status301CacheAge))
+	}
+	w.Header().Add("Status-Code", strconv.Itoa(rec.Code))
+	http.Redirect(w, r, rec.Root, rec.Code)
+	if c.Prometheus.Enable {
+		RequestsByStatus.WithLabelValues(host, strconv.Itoa(rec.Code)).Add(1)
+	}
+}
@@ -15,6 +15,7 @@ package minitxtd
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -22,6 +23,8 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -70,12 +73,45 @@ var txts = map[string]string{
 	"_redirect.correct.fallbackdockerv2.test.": "v=txtv0;to=https://gcr.io/;type=dockerv2",
 	"_redirect.wrong.fallbackdockerv2.test.":   "v=txtv0;to=://gcr.io/;type=dockerv2",
 
+	// CNAME targets
+	"_redirect.shared.test.": "v=txtv0;to=https://shared.test;type=host",
+
 	// type=gometa
 	"_redirect.fallbackgometa.test.":          "v=txtv0;type=path",
 	"_redirect.website.fallbackgometa.test.":  "v=txtv0;to=https://github.com/okkur/reposeed-server/;website=https://about.okkur.io/;type=gometa",
 	"_redirect.redirect.fallbackgometa.test.": "v=txtv0;to=https://github.com/okkur/reposeed-server/;type=gometa",
 }
 
+// Testing CNAMEs, their answers are followed by the records of the target
+var cnames = map[string]string{
+	"_redirect.alias.test.":       "_redirect.shared.test.",
+	"_redirect.chain.alias.test.": "_redirect.alias.test.",
+}
+
+// longPath makes the testing records exceed a single character-string
+var longPath = strings.Repeat("segment/", 40)
+
+// Testing TXT records made of several character-strings or several RRs.
+// Each item is the character-strings of a single RR.
+var splitTxts = map[string][][]string{
+	"_redirect.long.test.": {
+		{"v=txtv0;to=https://long.test/" + longPath[:200], longPath[200:] + ";type=host"},
+	},
+	"_redirect.multiple.test.": {
+		{"v=txtv0;to=https://first.multiple.test;type=host"},
+		{"v=txtv0;to=https://second.multiple.test;type=host"},
+	},
+	"_redirect.spf.test.": {
+		{"v=spf1 include:_spf.example.test ~all"},
+		{"v=txtv0;to=https://spf.test;type=host"},
+		{"verification-token=1234"},
+	},
+	"_redirect.priority.test.": {
+		{"v=txtv0;to=https://low.priority.test;type=host;priority=20"},
+		{"v=txtv0;to=https://high.priority.test;type=host;priority=10"},
+	},
+}
+
 // Testing DNS server port
 const port = 6000
 
@@ -83,7 +119,10 @@ const port = 6000
 var server = &dns.Server{Addr: ":" + strconv.Itoa(port), Net: "udp"}
 
 func TestMain(m *testing.M) {
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
 	go RunDNSServer()
+	<-started
 	os.Exit(m.Run())
 }
 
@@ -134,9 +173,29 @@ func parseDNSQuery(m *dns.Msg) {
 		switch q.Qtype {
 		case dns.TypeTXT:
 			log.Printf("Query for %s\n", q.Name)
+			name := q.Name
+			for target, ok := cnames[name]; ok; target, ok = cnames[name] {
+				m.Answer = append(m.Answer, &dns.CNAME{
+					Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 30},
+					Target: target,
+				})
+				if target == name {
+					break
+				}
+				name = target
+			}
+			if rrs, ok := splitTxts[name]; ok {
+				for _, strs := range rrs {
+					m.Answer = append(m.Answer, &dns.TXT{
+						Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+						Txt: strs,
+					})
+				}
+				continue
+			}
 			m.Answer = append(m.Answer, &dns.TXT{
-				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
-				Txt: []string{txts[q.Name]},
+				Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{txts[name]},
 			})
 		}
 	}
@@ -485,25 +544,33 @@ func Test_isIP(t *testing.T) {
 	}
 }
 
-func Test_customResolver(t *testing.T) {
+func Test_resolverAddress(t *testing.T) {
 	tests := []struct {
-		config Config
+		config   Config
+		expected string
 	}{
 		{
 			Config{
 				Resolver: "127.0.0.1",
 			},
+			"127.0.0.1:53",
+		},
+		{
+			Config{
+				Resolver: "8.8.8.8:5353",
+			},
+			"8.8.8.8:5353",
 		},
 		{
 			Config{
-				Resolver: "8.8.8.8",
+				Resolver: "::1",
 			},
+			"[::1]:53",
 		},
 	}
 	for _, test := range tests {
-		resolver := customResolver(test.config)
-		if resolver.PreferGo != true {
-			t.Errorf("Expected PreferGo option to be enabled in the returned resolver")
+		if addr := resolverAddress(test.config); addr != test.expected {
+			t.Errorf("Expected resolver address to be %s but got %s", test.expected, addr)
 		}
 	}
 }
@@ -539,13 +606,13 @@ func Test_contains(t *testing.T) {
 
 func Test_getBaseTarget(t *testing.T) {
 	tests := []struct {
-		record record
+		record Record
 		reqURL string
 		url    string
 		status int
 	}{
 		{
-			record{
+			Record{
 				To:   "https://example.test",
 				Code: 200,
 			},
@@ -554,7 +621,7 @@ func Test_getBaseTarget(t *testing.T) {
 			200,
 		},
 		{
-			record{
+			Record{
 				To:   "https://{host}/{method}",
 				Code: 200,
 			},
@@ -563,7 +630,7 @@ func Test_getBaseTarget(t *testing.T) {
 			200,
 		},
 		{
-			record{
+			Record{
 				To:   "https://testing.test{path}",
 				Code: 301,
 			},
@@ -715,3 +782,58 @@ func (u *fakeUpstream) Select(r *http.Request) *proxy.UpstreamHost {
 	}
 	return u.host
 }
+
+func Test_queryCoalescing(t *testing.T) {
+	var queries int32
+	release := make(chan struct{})
+	dns.HandleFunc("coalesce.test.", func(w dns.ResponseWriter, r *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		<-release
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{"v=txtv0;to=https://coalesce.test"},
+		})
+		w.WriteMsg(m)
+	})
+	defer dns.HandleRemove("coalesce.test.")
+
+	c := Config{
+		Resolver: "127.0.0.1:" + strconv.Itoa(port),
+	}
+
+	// A waiter whose request is canceled shouldn't wait for the shared lookup
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := query("coalesce.test", ctx, c); err == nil {
+		t.Errorf("Expected the canceled request to return an error")
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			txts, err := query("coalesce.test", context.Background(), c)
+			if err == nil && txts[0] != "v=txtv0;to=https://coalesce.test" {
+				err = fmt.Errorf("unexpected record %s", txts[0])
+			}
+			errs <- err
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err)
+		}
+	}
+	if got := atomic.LoadInt32(&queries); got != 1 {
+		t.Errorf("Expected concurrent lookups to be coalesced into 1 query, got %d", got)
+	}
+}
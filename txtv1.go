@@ -0,0 +1,213 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The txtv1 grammar of the TXT records:
+//
+//	record = "v=txtv1" *( ";" pair ) [ ";" ]
+//	pair   = key "=" value
+//	key    = 1*( %x61-7A / DIGIT / "-" / "_" )   ; lowercase letters
+//	value  = quoted / plain
+//	quoted = DQUOTE *( qchar / "\" DQUOTE / "\\" ) DQUOTE
+//	plain  = *( any character except ";" and DQUOTE )
+//
+// Quoted values are taken literally, so they can contain ";" and "=".
+// Plain values are taken literally as well, their percent-encodings are
+// kept as-is so URLs keep their own escaping, e.g. an encoded ";" in the
+// query. A literal ";" or DQUOTE needs a quoted value.
+// Every key can only be used once except the to= key, which holds the
+// targets of the record.
+const txtv1Prefix = "v=txtv1"
+
+// recordPair is a single key=value pair of a TXT record
+type recordPair struct {
+	key   string
+	value string
+	// raw is the pair as it's written in a txtv0 record
+	raw string
+	// offset is the position of the pair in the record
+	offset int
+}
+
+// recordSyntaxError is a txtv1 syntax error at the given offset
+type recordSyntaxError struct {
+	offset int
+	msg    string
+}
+
+func (e *recordSyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at offset %d: %s", e.offset, e.msg)
+}
+
+// isTxtv1 checks if the TXT record uses the txtv1 grammar
+func isTxtv1(txt string) bool {
+	return txt == txtv1Prefix || strings.HasPrefix(txt, txtv1Prefix+";")
+}
+
+// splitRecord splits the TXT record into its key=value pairs
+// using the grammar of the record's version
+func splitRecord(txt string) ([]recordPair, error) {
+	if isTxtv1(txt) {
+		return parseTxtv1(txt)
+	}
+
+	// txtv0 records are split on ";" and the first "=" of each pair
+	var pairs []recordPair
+	offset := 0
+	for _, l := range strings.Split(txt, ";") {
+		p := recordPair{raw: l, offset: offset}
+		if i := strings.Index(l, "="); i != -1 {
+			p.key, p.value = l[:i], l[i+1:]
+		}
+		pairs = append(pairs, p)
+		offset += len(l) + 1
+	}
+	return pairs, nil
+}
+
+// parseTxtv1 parses the txtv1 TXT record and reports the offset
+// of the syntax errors
+func parseTxtv1(txt string) ([]recordPair, error) {
+	var pairs []recordPair
+	seen := make(map[string]int)
+	i := 0
+	for i < len(txt) {
+		start := i
+		for i < len(txt) && isKeyChar(txt[i]) {
+			i++
+		}
+		if i == start {
+			return nil, &recordSyntaxError{start, "expected a key"}
+		}
+		key := txt[start:i]
+		if i == len(txt) || txt[i] != '=' {
+			return nil, &recordSyntaxError{i, fmt.Sprintf("expected '=' after the %s key", key)}
+		}
+		i++
+
+		var value string
+		valueStart := i
+		if i < len(txt) && txt[i] == '"' {
+			var b strings.Builder
+			closed := false
+			for i++; i < len(txt); i++ {
+				if txt[i] == '\\' {
+					if i+1 == len(txt) || (txt[i+1] != '"' && txt[i+1] != '\\') {
+						return nil, &recordSyntaxError{i, "invalid escape sequence in the quoted value"}
+					}
+					i++
+					b.WriteByte(txt[i])
+					continue
+				}
+				if txt[i] == '"' {
+					closed = true
+					i++
+					break
+				}
+				b.WriteByte(txt[i])
+			}
+			if !closed {
+				return nil, &recordSyntaxError{valueStart, "unterminated quoted value"}
+			}
+			if i < len(txt) && txt[i] != ';' {
+				return nil, &recordSyntaxError{i, "expected ';' after the quoted value"}
+			}
+			value = b.String()
+		} else {
+			for i < len(txt) && txt[i] != ';' {
+				if txt[i] == '"' {
+					return nil, &recordSyntaxError{i, "unexpected '\"' in an unquoted value"}
+				}
+				i++
+			}
+			value = txt[valueStart:i]
+		}
+
+		if first, ok := seen[key]; ok && key != "to" {
+			return nil, &recordSyntaxError{start, fmt.Sprintf("duplicate %s key, first defined at offset %d", key, first)}
+		}
+		seen[key] = start
+		pairs = append(pairs, recordPair{key: key, value: value, offset: start})
+
+		// Skip the separator
+		i++
+	}
+
+	if len(pairs) == 0 || pairs[0].key != "v" || pairs[0].value != "txtv1" {
+		return nil, &recordSyntaxError{0, "txtv1 records must start with " + txtv1Prefix}
+	}
+	return pairs, nil
+}
+
+// joinRecord builds a TXT record from the given pairs. Values of txtv1
+// records are quoted when they need to be.
+func joinRecord(pairs []recordPair) string {
+	v1 := len(pairs) != 0 && pairs[0].key == "v" && pairs[0].value == "txtv1"
+	var parts []string
+	for _, p := range pairs {
+		switch {
+		case !v1 && p.key == "":
+			parts = append(parts, p.raw)
+		case v1:
+			parts = append(parts, p.key+"="+quoteValue(p.value))
+		default:
+			parts = append(parts, p.key+"="+p.value)
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// upgradeVersion switches txtv0 pairs to txtv1 when one of their values
+// contains ";", which only a quoted txtv1 value can hold. The v= pair of
+// txtv1 pairs is moved first as the grammar requires.
+func upgradeVersion(pairs []recordPair) []recordPair {
+	v, needsTxtv1 := -1, false
+	for i, p := range pairs {
+		if p.key == "v" {
+			v = i
+		}
+		if strings.Contains(p.value, ";") {
+			needsTxtv1 = true
+		}
+	}
+	if v == -1 || pairs[v].value != "txtv1" && !(pairs[v].value == "txtv0" && needsTxtv1) {
+		return pairs
+	}
+	upgraded := []recordPair{{key: "v", value: "txtv1"}}
+	for i, p := range pairs {
+		if i != v {
+			upgraded = append(upgraded, p)
+		}
+	}
+	return upgraded
+}
+
+func isKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+}
+
+// quoteValue quotes the txtv1 value if it can't be used as a plain value
+func quoteValue(value string) string {
+	if !strings.ContainsAny(value, ";\"\\") {
+		return value
+	}
+	value = strings.Replace(value, "\\", "\\\\", -1)
+	value = strings.Replace(value, "\"", "\\\"", -1)
+	return "\"" + value + "\""
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_parseTxtv1(t *testing.T) {
+	tests := []struct {
+		txt      string
+		expected []recordPair
+	}{
+		{
+			"v=txtv1;to=https://example.test/?a=1;code=301",
+			[]recordPair{
+				{key: "v", value: "txtv1", offset: 0},
+				{key: "to", value: "https://example.test/?a=1", offset: 8},
+				{key: "code", value: "301", offset: 37},
+			},
+		},
+		{
+			`v=txtv1;to="https://example.test/?a=1;b=2";type=host;`,
+			[]recordPair{
+				{key: "v", value: "txtv1", offset: 0},
+				{key: "to", value: "https://example.test/?a=1;b=2", offset: 8},
+				{key: "type", value: "host", offset: 43},
+			},
+		},
+		{
+			`v=txtv1;website="say \"hi\" \\o/"`,
+			[]recordPair{
+				{key: "v", value: "txtv1", offset: 0},
+				{key: "website", value: `say "hi" \o/`, offset: 8},
+			},
+		},
+		{
+			"v=txtv1;to=https://example.test/?a=1%3Bb=2%3bc=%223%22%20",
+			[]recordPair{
+				{key: "v", value: "txtv1", offset: 0},
+				{key: "to", value: "https://example.test/?a=1%3Bb=2%3bc=%223%22%20", offset: 8},
+			},
+		},
+		{
+			"v=txtv1;to=https://a.test;to=https://b.test;weight=1,1;x-custom=",
+			[]recordPair{
+				{key: "v", value: "txtv1", offset: 0},
+				{key: "to", value: "https://a.test", offset: 8},
+				{key: "to", value: "https://b.test", offset: 26},
+				{key: "weight", value: "1,1", offset: 44},
+				{key: "x-custom", value: "", offset: 55},
+			},
+		},
+	}
+	for _, test := range tests {
+		pairs, err := parseTxtv1(test.txt)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %s", test.txt, err)
+			continue
+		}
+		if len(pairs) != len(test.expected) {
+			t.Errorf("Expected %v for %s, got %v", test.expected, test.txt, pairs)
+			continue
+		}
+		for i := range pairs {
+			if pairs[i] != test.expected[i] {
+				t.Errorf("Expected %+v for %s, got %+v", test.expected[i], test.txt, pairs[i])
+			}
+		}
+	}
+}
+
+func Test_parseTxtv1Errors(t *testing.T) {
+	tests := []struct {
+		txt      string
+		expected string
+	}{
+		{"v=txtv1;code=301;code=302", "syntax error at offset 17: duplicate code key, first defined at offset 8"},
+		{"v=txtv1;to", "syntax error at offset 10: expected '=' after the to key"},
+		{"v=txtv1;;to=https://example.test", "syntax error at offset 8: expected a key"},
+		{"v=txtv1;Type=host", "syntax error at offset 8: expected a key"},
+		{`v=txtv1;to="https://example.test`, "syntax error at offset 11: unterminated quoted value"},
+		{`v=txtv1;to="https://example.test"x`, "syntax error at offset 33: expected ';' after the quoted value"},
+		{`v=txtv1;to="a\b"`, "syntax error at offset 13: invalid escape sequence in the quoted value"},
+		{`v=txtv1;to=https://"example.test"`, "syntax error at offset 19: unexpected '\"' in an unquoted value"},
+		{"v=txtv1;v=txtv1", "syntax error at offset 8: duplicate v key, first defined at offset 0"},
+	}
+	for _, test := range tests {
+		_, err := parseTxtv1(test.txt)
+		if err == nil {
+			t.Errorf("Expected an error for %s", test.txt)
+			continue
+		}
+		if err.Error() != test.expected {
+			t.Errorf("Expected %q for %s, got %q", test.expected, test.txt, err)
+		}
+	}
+}
+
+func TestParseTxtv1Record(t *testing.T) {
+	req := httptest.NewRequest("GET", "https://example.test", nil)
+	c := Config{Enable: []string{"host", "path"}}
+
+	rec := Record{}
+	if err := rec.Parse(`v=txtv1;to="https://example.test/search?q=a;b";code=301`, req, c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if rec.Version != "txtv1" || rec.To != "https://example.test/search?q=a;b" || rec.Code != 301 || rec.Type != "host" {
+		t.Errorf("Unexpected record: %+v", rec)
+	}
+
+	// The encoded ";" of a plain value stays a part of the query's value
+	rec = Record{}
+	if err := rec.Parse("v=txtv1;to=https://x.test/?q=a%3Bb", req, c); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if rec.To != "https://x.test/?q=a%3Bb" {
+		t.Errorf("Expected the percent-encoding to be kept, got %s", rec.To)
+	}
+	if txt := rec.String(); !strings.Contains(txt, ";to=https://x.test/?q=a%3Bb;") {
+		t.Errorf("Expected the plain value to round-trip, got %s", txt)
+	}
+
+	for _, txt := range []string{
+		"to=https://example.test;v=txtv1",
+		"v=txtv1;type=path;type=host",
+		"v=txtv1;to=https://example.test;re=\"unterminated",
+	} {
+		rec := Record{}
+		if err := rec.Parse(txt, req, c); err == nil {
+			t.Errorf("Expected an error for %s", txt)
+		}
+	}
+
+	// txtv0 records are still split on every ";"
+	rec = Record{}
+	if err := rec.Parse("v=txtv0;to=https://example.test/?a=1;b=2", req, c); err != nil || rec.To != "https://example.test/?a=1" {
+		t.Errorf("Expected txtv0 to cut the target at ';', got %s: %v", rec.To, err)
+	}
+	rec = Record{}
+	if err := rec.Parse("v=txtv0;to=https://example.test/?a=1;b=2=3", req, c); err == nil {
+		t.Errorf("Expected txtv0 to reject the arbitrary data")
+	}
+}
+
+func Test_joinRecord(t *testing.T) {
+	for _, txt := range []string{
+		"v=txtv1;to=https://example.test/?a=1;code=301",
+		`v=txtv1;to="https://example.test/?a=1;b=2";website="say \"hi\""`,
+		"v=txtv1;to=https://example.test/?q=a%3Bb%20",
+		"v=txtv0;to=https://example.test;code=302",
+	} {
+		pairs, err := splitRecord(txt)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %s", txt, err)
+		}
+		if joined := joinRecord(pairs); joined != txt {
+			t.Errorf("Expected %s, got %s", txt, joined)
+		}
+	}
+}
+
+func TestTxtv1E2e(t *testing.T) {
+	c := Config{
+		Enable: []string{"host", "path"},
+		Source: NewStaticSource(map[string][]string{
+			"v1.test":                   {`v=txtv1;to="https://example.test/search?q=a;b";code=301`},
+			"path.v1.test":              {"v=txtv1;to=https://path.v1.test;type=path"},
+			"_redirect.id.path.v1.test": {`v=txtv1;to="https://id.v1.test/{>X-Id}";code=302`},
+		}),
+	}
+	tests := []struct {
+		url      string
+		id       string
+		expected string
+	}{
+		{"https://v1.test", "", "https://example.test/search?q=a;b"},
+		{"https://path.v1.test/id", "1", "https://id.v1.test/1"},
+		// The header can't add keys to the record
+		{"https://path.v1.test/id", `2";code=301;to="https://evil.test`, `https://id.v1.test/2";code=301;to="https://evil.test`},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Header.Set("X-Id", test.id)
+		resp := httptest.NewRecorder()
+		if err := c.Serve(resp, req); err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		if location := resp.Header().Get("Location"); location != test.expected {
+			t.Errorf("Expected %s to redirect to %s, got %s", test.url, test.expected, location)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultResolverStrategy = "sequential"
+	DefaultResolverTimeout  = 2 * time.Second
+	DefaultResolverMaxFails = 3
+	DefaultResolverEjectFor = 30 * time.Second
+)
+
+// Resolvers contains the configuration of the upstream DNS resolvers.
+// When Upstreams is empty the single Config.Resolver is used instead.
+type Resolvers struct {
+	Upstreams []Upstream
+	Strategy  string
+	Timeout   time.Duration
+	// MaxFails is the number of consecutive failures after which an
+	// upstream gets ejected for the EjectFor duration
+	MaxFails int
+	EjectFor time.Duration
+
+	pool *upstreamPool
+}
+
+// Upstream is a single upstream DNS resolver. Address accepts the
+// same formats as Config.Resolver.
+type Upstream struct {
+	Address string
+	Timeout time.Duration
+}
+
+// upstreamPool keeps the passive health state of the upstreams
+type upstreamPool struct {
+	sync.Mutex
+	health map[string]*upstreamHealth
+	now    func() time.Time
+}
+
+type upstreamHealth struct {
+	fails        int
+	ejectedUntil time.Time
+	rtt          time.Duration
+}
+
+// SetDefaults sets the default values for resolvers config
+// if the fields are empty
+func (rs *Resolvers) SetDefaults() {
+	if rs.Strategy == "" {
+		rs.Strategy = DefaultResolverStrategy
+	}
+	if rs.Timeout == 0 {
+		rs.Timeout = DefaultResolverTimeout
+	}
+	if rs.MaxFails == 0 {
+		rs.MaxFails = DefaultResolverMaxFails
+	}
+	if rs.EjectFor == 0 {
+		rs.EjectFor = DefaultResolverEjectFor
+	}
+	if rs.pool == nil {
+		rs.pool = &upstreamPool{
+			health: make(map[string]*upstreamHealth),
+			now:    time.Now,
+		}
+	}
+}
+
+// sameSettings reports whether both resolvers are configured the same way
+func (rs Resolvers) sameSettings(other Resolvers) bool {
+	if rs.Strategy != other.Strategy || rs.Timeout != other.Timeout || rs.MaxFails != other.MaxFails ||
+		rs.EjectFor != other.EjectFor || len(rs.Upstreams) != len(other.Upstreams) {
+		return false
+	}
+	for i := range rs.Upstreams {
+		if rs.Upstreams[i] != other.Upstreams[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// exchange sends the given DNS message to the upstreams in the order
+// chosen by the strategy and fails over to the next upstream when one
+// of them doesn't answer or answers with a server failure. It returns
+// the response and the address of the upstream that has been used.
+func (rs Resolvers) exchange(ctx context.Context, m *dns.Msg, c Config) (*dns.Msg, string, error) {
+	if len(rs.Upstreams) == 0 {
+		addr := resolverAddress(c)
+		resp, err := exchange(ctx, m, addr)
+		return resp, addr, err
+	}
+
+	var addr string
+	var resp *dns.Msg
+	var err error
+	for _, u := range rs.order() {
+		addr = normalizeResolver(u.Address)
+		timeout := u.Timeout
+		if timeout == 0 {
+			timeout = rs.Timeout
+		}
+		if timeout == 0 {
+			timeout = DefaultResolverTimeout
+		}
+
+		start := time.Now()
+		uctx, cancel := context.WithTimeout(ctx, timeout)
+		resp, err = exchange(uctx, m, addr)
+		cancel()
+		if err != nil {
+			// The request is gone, so it's not the upstream's fault
+			if ctx.Err() != nil {
+				break
+			}
+			rs.failed(addr, c)
+			continue
+		}
+		rs.succeeded(addr, time.Since(start), c)
+
+		if resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused {
+			err = fmt.Errorf("%s", dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		return resp, addr, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("no upstream resolvers available")
+	}
+	return nil, addr, err
+}
+
+// order returns the upstreams in the order they should be tried based
+// on the strategy. Ejected upstreams are only tried as the last resort.
+func (rs Resolvers) order() []Upstream {
+	var healthy, ejected []Upstream
+	for _, u := range rs.Upstreams {
+		if rs.ejected(u.Address) {
+			ejected = append(ejected, u)
+			continue
+		}
+		healthy = append(healthy, u)
+	}
+
+	switch rs.Strategy {
+	case "random":
+		rand.Shuffle(len(healthy), func(i, j int) {
+			healthy[i], healthy[j] = healthy[j], healthy[i]
+		})
+	case "fastest":
+		sort.SliceStable(healthy, func(i, j int) bool {
+			return rs.rtt(healthy[i].Address) < rs.rtt(healthy[j].Address)
+		})
+	}
+
+	return append(healthy, ejected...)
+}
+
+// ejected checks if the given upstream is temporarily ejected
+func (rs Resolvers) ejected(addr string) bool {
+	if rs.pool == nil {
+		return false
+	}
+	p := rs.pool
+	p.Lock()
+	defer p.Unlock()
+	h, ok := p.health[normalizeResolver(addr)]
+	return ok && p.now().Before(h.ejectedUntil)
+}
+
+// rtt returns the smoothed round trip time of the given upstream.
+// Upstreams without any measurements are preferred so they get measured.
+func (rs Resolvers) rtt(addr string) time.Duration {
+	if rs.pool == nil {
+		return 0
+	}
+	p := rs.pool
+	p.Lock()
+	defer p.Unlock()
+	if h, ok := p.health[normalizeResolver(addr)]; ok {
+		return h.rtt
+	}
+	return 0
+}
+
+// failed records a failed exchange and ejects the upstream when it
+// reaches the maximum number of consecutive failures
+func (rs Resolvers) failed(addr string, c Config) {
+	if c.Prometheus.Enable {
+		ResolverFailures.WithLabelValues(addr).Add(1)
+	}
+	if rs.pool == nil {
+		return
+	}
+	p := rs.pool
+	p.Lock()
+	defer p.Unlock()
+	h := p.get(addr)
+	h.fails++
+	if rs.MaxFails > 0 && h.fails >= rs.MaxFails {
+		h.fails = 0
+		h.ejectedUntil = p.now().Add(rs.EjectFor)
+		if c.Prometheus.Enable {
+			ResolverHealth.WithLabelValues(addr).Set(0)
+		}
+	}
+}
+
+// succeeded records a successful exchange and its round trip time
+func (rs Resolvers) succeeded(addr string, rtt time.Duration, c Config) {
+	if c.Prometheus.Enable {
+		ResolverHealth.WithLabelValues(addr).Set(1)
+	}
+	if rs.pool == nil {
+		return
+	}
+	p := rs.pool
+	p.Lock()
+	defer p.Unlock()
+	h := p.get(addr)
+	h.fails = 0
+	h.ejectedUntil = time.Time{}
+	if h.rtt == 0 {
+		h.rtt = rtt
+	} else {
+		// Exponentially weighted moving average
+		h.rtt = (h.rtt*7 + rtt) / 8
+	}
+}
+
+// get returns the health state of the given upstream. The caller
+// must hold the pool's lock.
+func (p *upstreamPool) get(addr string) *upstreamHealth {
+	h, ok := p.health[addr]
+	if !ok {
+		h = &upstreamHealth{}
+		p.health[addr] = h
+	}
+	return h
+}
+
+// resolverKey identifies the resolvers that are used by the given config
+func resolverKey(c Config) string {
+	if len(c.Resolvers.Upstreams) == 0 {
+		return c.Resolver
+	}
+	addrs := []string{}
+	for _, u := range c.Resolvers.Upstreams {
+		addrs = append(addrs, u.Address)
+	}
+	return strings.Join(addrs, ",")
+}
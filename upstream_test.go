@@ -0,0 +1,110 @@
+/*
+Copyright 2019 - The TXTDirect Authors
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package minitxtd
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// deadResolver is an address where nothing answers DNS queries
+const deadResolver = "127.0.0.1:1"
+
+func TestResolversFailover(t *testing.T) {
+	for _, strategy := range []string{"sequential", "random", "fastest"} {
+		c := Config{
+			Resolvers: Resolvers{
+				Upstreams: []Upstream{
+					{Address: deadResolver, Timeout: 200 * time.Millisecond},
+					{Address: "127.0.0.1:" + strconv.Itoa(port)},
+				},
+				Strategy: strategy,
+				MaxFails: 2,
+			},
+			Prometheus: Prometheus{
+				Enable: true,
+			},
+		}
+		c.Resolvers.SetDefaults()
+
+		// The random strategy doesn't always try the dead resolver first
+		for i := 0; i < 50 && !c.Resolvers.ejected(deadResolver); i++ {
+			resp, err := query("_redirect.about.test.", context.Background(), c)
+			if err != nil {
+				t.Fatalf("Strategy %s: Expected the query to fail over, got error: %s", strategy, err)
+			}
+			if resp[0] != txts["_redirect.about.test."] {
+				t.Fatalf("Strategy %s: Expected %s, got %s", strategy, txts["_redirect.about.test."], resp[0])
+			}
+		}
+
+		if !c.Resolvers.ejected(deadResolver) {
+			t.Errorf("Strategy %s: Expected the dead resolver to be ejected", strategy)
+		}
+		if order := c.Resolvers.order(); order[len(order)-1].Address != deadResolver {
+			t.Errorf("Strategy %s: Expected the ejected resolver to be tried last", strategy)
+		}
+		if health := testutil.ToFloat64(ResolverHealth.WithLabelValues(deadResolver)); health != 0 {
+			t.Errorf("Strategy %s: Expected the dead resolver's health metric to be 0, got %f", strategy, health)
+		}
+	}
+}
+
+func TestResolversEjectionExpires(t *testing.T) {
+	now := time.Now()
+	rs := Resolvers{
+		Upstreams: []Upstream{
+			{Address: deadResolver},
+		},
+		MaxFails: 1,
+		EjectFor: time.Minute,
+	}
+	rs.SetDefaults()
+	rs.pool.now = func() time.Time { return now }
+
+	rs.failed(deadResolver, Config{})
+	if !rs.ejected(deadResolver) {
+		t.Fatalf("Expected the resolver to be ejected")
+	}
+	now = now.Add(2 * time.Minute)
+	if rs.ejected(deadResolver) {
+		t.Errorf("Expected the resolver to be back after the ejection period")
+	}
+}
+
+func TestResolversFastest(t *testing.T) {
+	rs := Resolvers{
+		Upstreams: []Upstream{
+			{Address: "10.0.0.1:53"},
+			{Address: "10.0.0.2:53"},
+			{Address: "10.0.0.3:53"},
+		},
+		Strategy: "fastest",
+	}
+	rs.SetDefaults()
+	rs.succeeded("10.0.0.1:53", 30*time.Millisecond, Config{})
+	rs.succeeded("10.0.0.2:53", 10*time.Millisecond, Config{})
+	rs.succeeded("10.0.0.3:53", 20*time.Millisecond, Config{})
+
+	expected := []string{"10.0.0.2:53", "10.0.0.3:53", "10.0.0.1:53"}
+	for i, u := range rs.order() {
+		if u.Address != expected[i] {
+			t.Errorf("Expected %s to be tried at position %d, got %s", expected[i], i, u.Address)
+		}
+	}
+}